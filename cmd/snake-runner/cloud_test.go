@@ -21,7 +21,7 @@ func init() {
 // func TestSidecar(t *testing.T) {
 //    test := assert.New(t)
 
-//    docker, err := cloud.NewDocker("host")
+//    docker, err := docker.NewDocker("host", nil)
 //    test.NoError(err)
 
 //    outputConsumer := func(text string) error {
@@ -47,7 +47,7 @@ func init() {
 //    dir := "/tmp/snake-runner.test.pipelines." + utils.RandString(8)
 
 //    sidecar := sidecar.NewSidecarBuilder().
-//        Cloud(docker).
+//        Executor(docker).
 //        Name(sidecarName).
 //        PipelinesDir(dir).
 //        Slug("testproj/testrepo").
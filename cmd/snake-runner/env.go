@@ -2,12 +2,25 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/reconquest/karma-go"
 	"github.com/reconquest/snake-runner/internal/config"
+	"github.com/reconquest/snake-runner/internal/sidecar"
 	"github.com/reconquest/snake-runner/internal/snake"
 	"github.com/reconquest/snake-runner/internal/tasks"
 )
 
+// MaxChangedFilesSize is a max size of CI_CHANGED_FILES in bytes.
+const MaxChangedFilesSize = 64 * 1024
+
+// FilesDir is a directory in job containers where file variables are
+// written, it's a tmpfs mount, so files never get to the disk.
+const FilesDir = "/run/snake/files"
+
 //go:generate gonstructor -type EnvBuilder
 type EnvBuilder struct {
 	task         tasks.PipelineRun
@@ -17,35 +30,98 @@ type EnvBuilder struct {
 	configJob    config.Job
 	runnerConfig *RunnerConfig
 	containerDir string
+
+	// mergeBase is a merge base of the pull request and its target branch,
+	// it's known only if the merge result of the pull request is checked out.
+	mergeBase string
+
+	// commit is metadata of the pipeline commit, changedFiles are files
+	// changed by the pipeline and nil if they are unknown.
+	commit       sidecar.Commit
+	changedFiles []string
 }
 
 type Env struct {
 	mapping map[string]string
 	values  []string
+	files   map[string]string
 }
 
 func (env *Env) GetAll() []string {
 	return env.values
 }
 
+// GetFiles returns contents of file variables by paths of files.
+func (env *Env) GetFiles() map[string]string {
+	return env.files
+}
+
 func (env *Env) Get(key string) (string, bool) {
 	value, ok := env.mapping[key]
 	return value, ok
 }
 
-func (builder *EnvBuilder) Build() Env {
-	mapping := builder.build()
+// Expand replaces $VAR and ${VAR} in the given text with values of variables,
+// unknown variables are replaced with empty strings like shell does.
+func (env *Env) Expand(text string) string {
+	return os.Expand(text, func(name string) string {
+		value, _ := env.Get(name)
+		return value
+	})
+}
+
+// Build returns variables of the job, values are sorted by names.
+func (builder *EnvBuilder) Build() (Env, error) {
+	mapping, err := builder.build()
+	if err != nil {
+		return Env{}, err
+	}
+
+	files := builder.buildFiles(mapping)
+
 	values := []string{}
-	for key, value := range builder.build() {
-		values = append(values, key+"="+value)
+	for _, key := range getSortedKeys(mapping) {
+		values = append(values, key+"="+mapping[key])
 	}
+
 	return Env{
 		mapping: mapping,
 		values:  values,
+		files:   files,
+	}, nil
+}
+
+// buildFiles replaces values of file variables with paths of files in
+// FilesDir and returns contents of the files by their paths.
+func (builder *EnvBuilder) buildFiles(vars map[string]string) map[string]string {
+	names := append([]string{}, builder.task.Files...)
+	names = append(names, builder.config.Files...)
+	names = append(names, builder.configJob.Files...)
+
+	files := map[string]string{}
+	for _, name := range names {
+		value, ok := vars[name]
+		if !ok {
+			continue
+		}
+
+		path := FilesDir + "/" + name
+		if _, ok := files[path]; ok {
+			continue
+		}
+
+		files[path] = value
+		vars[name] = path
 	}
+
+	return files
 }
 
-func (builder *EnvBuilder) build() map[string]string {
+// build merges variables in order of precedence: variables of the runner,
+// variables of the server, variables of the pipeline and variables of the job.
+// References to variables are expanded only in variables of the pipeline and
+// the job.
+func (builder *EnvBuilder) build() (map[string]string, error) {
 	vars := map[string]string{}
 
 	vars["CI"] = "true"
@@ -66,10 +142,43 @@ func (builder *EnvBuilder) build() map[string]string {
 		vars["CI_COMMIT_SHORT_HASH"] = builder.pipeline.Commit[0:6]
 	}
 
+	if builder.commit.Hash != "" {
+		commit := builder.commit
+
+		vars["CI_COMMIT_TITLE"] = commit.Title
+		vars["CI_COMMIT_MESSAGE"] = commit.Message
+		vars["CI_COMMIT_AUTHOR"] = fmt.Sprintf(
+			"%s <%s>",
+			commit.AuthorName,
+			commit.AuthorEmail,
+		)
+		vars["CI_COMMIT_AUTHOR_NAME"] = commit.AuthorName
+		vars["CI_COMMIT_AUTHOR_EMAIL"] = commit.AuthorEmail
+		vars["CI_COMMIT_TIMESTAMP"] = commit.Timestamp.Format(time.RFC3339)
+		vars["CI_COMMIT_PARENT_HASHES"] = strings.Join(commit.Parents, " ")
+	}
+
+	if builder.pipeline.PreviousSuccessfulCommit != "" {
+		vars["CI_PREVIOUS_SUCCESSFUL_COMMIT_HASH"] = builder.pipeline.PreviousSuccessfulCommit
+	}
+
+	if builder.changedFiles != nil {
+		vars["CI_CHANGED_FILES"], vars["CI_CHANGED_FILES_TRUNCATED"] =
+			formatChangedFiles(builder.changedFiles)
+	}
+
 	vars["CI_PIPELINE_DIR"] = builder.containerDir
 
 	if builder.pipeline.PullRequestID > 0 {
 		vars["CI_PULL_REQUEST_ID"] = fmt.Sprint(builder.pipeline.PullRequestID)
+
+		if builder.pipeline.PullRequestTargetBranch != "" {
+			vars["CI_PULL_REQUEST_TARGET_BRANCH"] = builder.pipeline.PullRequestTargetBranch
+		}
+
+		if builder.mergeBase != "" {
+			vars["CI_PULL_REQUEST_MERGE_BASE"] = builder.mergeBase
+		}
 	}
 
 	vars["CI_PROJECT_KEY"] = builder.task.Project.Key
@@ -86,17 +195,189 @@ func (builder *EnvBuilder) build() map[string]string {
 	vars["CI_RUNNER_NAME"] = fmt.Sprint(builder.runnerConfig.Name)
 	vars["CI_RUNNER_VERSION"] = fmt.Sprint(version)
 
+	// variables of the server are passed as is since they are often secrets
+	// like passwords which can contain $
 	for key, value := range builder.task.Env {
 		vars[key] = value
 	}
 
-	for key, value := range builder.config.Variables {
-		vars[key] = value
+	layers := []struct {
+		name string
+		vars map[string]string
+	}{
+		{"pipeline", builder.config.Variables},
+		{"job", builder.configJob.Variables},
 	}
 
-	for key, value := range builder.configJob.Variables {
-		vars[key] = value
+	for _, layer := range layers {
+		expanded, err := expandVariables(vars, layer.vars)
+		if err != nil {
+			return nil, karma.Format(
+				err,
+				"unable to expand %s variables", layer.name,
+			)
+		}
+
+		for key, value := range expanded {
+			vars[key] = value
+		}
+	}
+
+	return vars, nil
+}
+
+// expandVariables expands references in values of the layer: a reference to
+// a variable of the same layer is expanded recursively, other references are
+// resolved by variables of previous layers and unknown references are kept
+// exactly as written, so they can be expanded by the shell. A variable referencing itself
+// gets the value of previous layers, like PATH: $PATH:/opt/bin. $$ is
+// replaced with $.
+func expandVariables(
+	base map[string]string,
+	layer map[string]string,
+) (map[string]string, error) {
+	expanded := map[string]string{}
+	stack := []string{}
+
+	var resolve func(key string) (string, error)
+	resolve = func(key string) (string, error) {
+		if value, ok := expanded[key]; ok {
+			return value, nil
+		}
+
+		for index, resolving := range stack {
+			if resolving == key {
+				return "", fmt.Errorf(
+					"cyclic reference: %s",
+					strings.Join(append(stack[index:], key), " → "),
+				)
+			}
+		}
+
+		stack = append(stack, key)
+		defer func() {
+			stack = stack[:len(stack)-1]
+		}()
+
+		var err error
+		value := expandReferences(layer[key], func(name string) (string, bool) {
+			if _, ok := layer[name]; ok && name != key {
+				value, resolveErr := resolve(name)
+				if resolveErr != nil && err == nil {
+					err = resolveErr
+				}
+
+				return value, true
+			}
+
+			value, ok := base[name]
+			return value, ok
+		})
+		if err != nil {
+			return "", err
+		}
+
+		expanded[key] = value
+
+		return value, nil
 	}
 
-	return vars
+	for _, key := range getSortedKeys(layer) {
+		_, err := resolve(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return expanded, nil
+}
+
+// expandReferences replaces $NAME and ${NAME} in the text using the given
+// function, $$ is replaced with $. References unknown to the function are
+// kept exactly as written.
+func expandReferences(
+	text string,
+	lookup func(name string) (string, bool),
+) string {
+	result := strings.Builder{}
+	for index := 0; index < len(text); index++ {
+		if text[index] != '$' || index+1 == len(text) {
+			result.WriteByte(text[index])
+			continue
+		}
+
+		if text[index+1] == '$' {
+			result.WriteByte('$')
+			index++
+			continue
+		}
+
+		begin, end := index+1, index+1
+		if text[begin] == '{' {
+			closing := strings.IndexByte(text[begin:], '}')
+			if closing == -1 {
+				result.WriteByte('$')
+				continue
+			}
+
+			begin, end = begin+1, begin+closing
+		} else {
+			for end < len(text) && isNameChar(text[end]) {
+				end++
+			}
+		}
+
+		reference := text[index:end]
+		if text[index+1] == '{' {
+			reference = text[index : end+1]
+		}
+
+		value, ok := "", false
+		if end > begin {
+			value, ok = lookup(text[begin:end])
+		}
+
+		if ok {
+			result.WriteString(value)
+		} else {
+			result.WriteString(reference)
+		}
+
+		index += len(reference) - 1
+	}
+
+	return result.String()
+}
+
+func isNameChar(char byte) bool {
+	return char == '_' ||
+		(char >= 'a' && char <= 'z') ||
+		(char >= 'A' && char <= 'Z') ||
+		(char >= '0' && char <= '9')
+}
+
+// formatChangedFiles returns paths separated by newlines, the list is
+// truncated to MaxChangedFilesSize since a single environment variable
+// can't be larger than 128KiB.
+func formatChangedFiles(files []string) (string, string) {
+	size := 0
+	for index, path := range files {
+		size += len(path) + 1
+		if size > MaxChangedFilesSize {
+			return strings.Join(files[:index], "\n"), "true"
+		}
+	}
+
+	return strings.Join(files, "\n"), "false"
+}
+
+func getSortedKeys(mapping map[string]string) []string {
+	keys := []string{}
+	for key := range mapping {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
 }
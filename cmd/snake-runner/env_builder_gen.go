@@ -4,10 +4,11 @@ package main
 
 import (
 	"github.com/reconquest/snake-runner/internal/config"
+	"github.com/reconquest/snake-runner/internal/sidecar"
 	"github.com/reconquest/snake-runner/internal/snake"
 	"github.com/reconquest/snake-runner/internal/tasks"
 )
 
-func NewEnvBuilder(task tasks.PipelineRun, pipeline snake.Pipeline, job snake.PipelineJob, config config.Pipeline, configJob config.Job, runnerConfig *RunnerConfig, containerDir string) *EnvBuilder {
-	return &EnvBuilder{task: task, pipeline: pipeline, job: job, config: config, configJob: configJob, runnerConfig: runnerConfig, containerDir: containerDir}
+func NewEnvBuilder(task tasks.PipelineRun, pipeline snake.Pipeline, job snake.PipelineJob, config config.Pipeline, configJob config.Job, runnerConfig *RunnerConfig, containerDir string, mergeBase string, commit sidecar.Commit, changedFiles []string) *EnvBuilder {
+	return &EnvBuilder{task: task, pipeline: pipeline, job: job, config: config, configJob: configJob, runnerConfig: runnerConfig, containerDir: containerDir, mergeBase: mergeBase, commit: commit, changedFiles: changedFiles}
 }
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/reconquest/snake-runner/internal/config"
 	"github.com/reconquest/snake-runner/internal/responses"
+	"github.com/reconquest/snake-runner/internal/sidecar"
 	"github.com/reconquest/snake-runner/internal/snake"
 	"github.com/reconquest/snake-runner/internal/tasks"
 	"github.com/stretchr/testify/assert"
@@ -45,12 +48,23 @@ func TestEnvBuilder(t *testing.T) {
 	configPipeline := config.Pipeline{}
 	configJob := config.Job{}
 
+	mergeBase := ""
+	commit := sidecar.Commit{}
+	changedFiles := []string(nil)
+
 	builder := func(pipeline snake.Pipeline) *EnvBuilder {
 		return NewEnvBuilder(
 			task, pipeline, job, configPipeline, configJob, &runnerConfig, "/dir",
+			mergeBase, commit, changedFiles,
 		)
 	}
 
+	build := func(pipeline snake.Pipeline) map[string]string {
+		vars, err := builder(pipeline).build()
+		test.NoError(err)
+		return vars
+	}
+
 	expected := map[string]string{
 		"user_a":                "user_a_value",
 		"CI":                    "true",
@@ -74,7 +88,7 @@ func TestEnvBuilder(t *testing.T) {
 	}
 
 	{
-		test.EqualValues(expected, builder(basicPipeline).build())
+		test.EqualValues(expected, build(basicPipeline))
 	}
 
 	{
@@ -85,7 +99,7 @@ func TestEnvBuilder(t *testing.T) {
 		expected := clone(expected)
 		expected["CI_BRANCH"] = "someref"
 
-		test.EqualValues(expected, builder(pipeline).build())
+		test.EqualValues(expected, build(pipeline))
 	}
 
 	{
@@ -96,7 +110,59 @@ func TestEnvBuilder(t *testing.T) {
 		expected := clone(expected)
 		expected["CI_TAG"] = "someref"
 
-		test.EqualValues(expected, builder(pipeline).build())
+		test.EqualValues(expected, build(pipeline))
+	}
+
+	{
+		pipeline := basicPipeline
+		pipeline.PullRequestID = 7
+		pipeline.PullRequestTargetBranch = "master"
+
+		expected := clone(expected)
+		expected["CI_PULL_REQUEST_ID"] = "7"
+		expected["CI_PULL_REQUEST_TARGET_BRANCH"] = "master"
+
+		test.EqualValues(expected, build(pipeline))
+
+		mergeBase = "0987654321"
+		expected["CI_PULL_REQUEST_MERGE_BASE"] = "0987654321"
+
+		test.EqualValues(expected, build(pipeline))
+
+		mergeBase = ""
+	}
+
+	{
+		pipeline := basicPipeline
+		pipeline.PreviousSuccessfulCommit = "0987654321"
+
+		commit = sidecar.Commit{
+			Hash:        "1234567890",
+			AuthorName:  "John Doe",
+			AuthorEmail: "john@example.com",
+			Timestamp:   time.Date(2020, 5, 1, 12, 30, 0, 0, time.UTC),
+			Title:       "fix build",
+			Message:     "fix build\n\ndetails",
+			Parents:     []string{"aaa", "bbb"},
+		}
+		changedFiles = []string{"go.mod", "cmd/main.go"}
+
+		expected := clone(expected)
+		expected["CI_COMMIT_TITLE"] = "fix build"
+		expected["CI_COMMIT_MESSAGE"] = "fix build\n\ndetails"
+		expected["CI_COMMIT_AUTHOR"] = "John Doe <john@example.com>"
+		expected["CI_COMMIT_AUTHOR_NAME"] = "John Doe"
+		expected["CI_COMMIT_AUTHOR_EMAIL"] = "john@example.com"
+		expected["CI_COMMIT_TIMESTAMP"] = "2020-05-01T12:30:00Z"
+		expected["CI_COMMIT_PARENT_HASHES"] = "aaa bbb"
+		expected["CI_PREVIOUS_SUCCESSFUL_COMMIT_HASH"] = "0987654321"
+		expected["CI_CHANGED_FILES"] = "go.mod\ncmd/main.go"
+		expected["CI_CHANGED_FILES_TRUNCATED"] = "false"
+
+		test.EqualValues(expected, build(pipeline))
+
+		commit = sidecar.Commit{}
+		changedFiles = nil
 	}
 
 	{
@@ -105,7 +171,7 @@ func TestEnvBuilder(t *testing.T) {
 		expected := clone(expected)
 		expected["foo"] = "global"
 
-		test.EqualValues(expected, builder(basicPipeline).build())
+		test.EqualValues(expected, build(basicPipeline))
 	}
 
 	{
@@ -114,7 +180,7 @@ func TestEnvBuilder(t *testing.T) {
 		expected := clone(expected)
 		expected["foo"] = "job"
 
-		test.EqualValues(expected, builder(basicPipeline).build())
+		test.EqualValues(expected, build(basicPipeline))
 	}
 
 	{
@@ -126,8 +192,108 @@ func TestEnvBuilder(t *testing.T) {
 		expected["qux"] = "quxjob"
 		expected["bar"] = "globalbar"
 
-		test.EqualValues(expected, builder(basicPipeline).build())
+		test.EqualValues(expected, build(basicPipeline))
+	}
+
+	{
+		task.Env = map[string]string{"KUBECONFIG": "apiVersion: v1"}
+		task.Files = []string{"KUBECONFIG"}
+		configJob.Variables = map[string]string{"CERT": "certificate"}
+		configJob.Files = []string{"CERT", "MISSING"}
+
+		env, err := builder(basicPipeline).Build()
+		test.NoError(err)
+
+		test.EqualValues(
+			map[string]string{
+				FilesDir + "/KUBECONFIG": "apiVersion: v1",
+				FilesDir + "/CERT":       "certificate",
+			},
+			env.GetFiles(),
+		)
+
+		value, _ := env.Get("KUBECONFIG")
+		test.Equal(FilesDir+"/KUBECONFIG", value)
+		test.Contains(env.GetAll(), "CERT="+FilesDir+"/CERT")
+
+		_, ok := env.Get("MISSING")
+		test.False(ok)
+	}
+}
+
+func TestEnvBuilderExpandsVariables(t *testing.T) {
+	test := assert.New(t)
+
+	task := tasks.PipelineRun{
+		Pipeline: snake.Pipeline{Commit: "1234567890"},
+		Env: map[string]string{
+			"REGISTRY": "registry.example.com",
+			"PATH":     "/usr/bin",
+			"TOKEN":    "pa$word1$$",
+		},
 	}
+
+	configPipeline := config.Pipeline{
+		Variables: map[string]string{
+			"IMAGE":     "$REGISTRY/app:${IMAGE_TAG}",
+			"IMAGE_TAG": "$CI_COMMIT_SHORT_HASH-dev",
+			"PATH":      "$PATH:/opt/bin",
+			"PRICE":     "$$5",
+			"HOME_BIN":  "$HOME/bin",
+			"USER_DIR":  "/home/${USER}/${",
+		},
+	}
+
+	configJob := config.Job{
+		Variables: map[string]string{
+			"IMAGE_TAG": "latest",
+			"DEPLOY":    "deploy $IMAGE",
+		},
+	}
+
+	env, err := NewEnvBuilder(
+		task, task.Pipeline, snake.PipelineJob{}, configPipeline, configJob,
+		&RunnerConfig{}, "/dir", "", sidecar.Commit{}, nil,
+	).Build()
+	test.NoError(err)
+
+	for key, expected := range map[string]string{
+		"IMAGE":     "registry.example.com/app:123456-dev",
+		"IMAGE_TAG": "latest",
+		"DEPLOY":    "deploy registry.example.com/app:123456-dev",
+		"PATH":      "/usr/bin:/opt/bin",
+		"PRICE":     "$5",
+		"HOME_BIN":  "$HOME/bin",
+		"USER_DIR":  "/home/${USER}/${",
+		"TOKEN":     "pa$word1$$",
+	} {
+		value, _ := env.Get(key)
+		test.Equal(expected, value, key)
+	}
+
+	test.True(sort.StringsAreSorted(env.GetAll()))
+	test.Equal("registry.example.com/app:latest", env.Expand("$REGISTRY/app:$IMAGE_TAG"))
+	test.Equal("/", env.Expand("$UNKNOWN/"))
+}
+
+func TestEnvBuilderDetectsCycles(t *testing.T) {
+	test := assert.New(t)
+
+	configPipeline := config.Pipeline{
+		Variables: map[string]string{
+			"A": "$B",
+			"B": "${C}",
+			"C": "$A",
+		},
+	}
+
+	_, err := NewEnvBuilder(
+		tasks.PipelineRun{}, snake.Pipeline{}, snake.PipelineJob{},
+		configPipeline, config.Job{}, &RunnerConfig{}, "/dir", "",
+		sidecar.Commit{}, nil,
+	).Build()
+	test.Error(err)
+	test.Contains(err.Error(), "cyclic reference: A → B → C → A")
 }
 
 func clone(original map[string]string) map[string]string {
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/reconquest/snake-runner/internal/executor"
+	"github.com/reconquest/snake-runner/internal/executor/docker"
+	"github.com/reconquest/snake-runner/internal/executor/shell"
+)
+
+func NewExecutor(config *RunnerConfig) (executor.Executor, error) {
+	switch config.Virtualization {
+	case VirtualizationDocker:
+		provider, err := docker.NewDocker(
+			config.Docker.Network,
+			config.Docker.Volumes,
+			config.Docker.Registries,
+			config.Docker.Config,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		return provider, nil
+
+	case VirtualizationNone:
+		return shell.NewShell(), nil
+
+	default:
+		return nil, fmt.Errorf(
+			"unexpected virtualization: %q, expected one of: %s, %s",
+			config.Virtualization,
+			VirtualizationDocker,
+			VirtualizationNone,
+		)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "strings"
+
+// LinePrefixer adds the prefix to every line of a stream of logs, so logs of
+// variants of a matrix job running at the same time can be told apart.
+//
+// An unfinished line is held back until its end is written, otherwise lines
+// of different variants would be mixed up.
+type LinePrefixer struct {
+	prefix  string
+	pending string
+}
+
+func NewLinePrefixer(prefix string) *LinePrefixer {
+	return &LinePrefixer{prefix: prefix}
+}
+
+// Write returns all finished lines of the stream with the prefix.
+func (prefixer *LinePrefixer) Write(text string) string {
+	text = prefixer.pending + text
+
+	end := strings.LastIndex(text, "\n")
+	if end < 0 {
+		prefixer.pending = text
+		return ""
+	}
+
+	prefixer.pending = text[end+1:]
+
+	result := strings.Builder{}
+	for _, line := range strings.SplitAfter(text[:end+1], "\n") {
+		if line == "" {
+			continue
+		}
+
+		result.WriteString(prefixer.prefix)
+		result.WriteString(line)
+	}
+
+	return result.String()
+}
+
+// Flush returns the unfinished line with the prefix, it's called when the
+// stream is over.
+func (prefixer *LinePrefixer) Flush() string {
+	if prefixer.pending == "" {
+		return ""
+	}
+
+	line := prefixer.prefix + prefixer.pending + "\n"
+	prefixer.pending = ""
+
+	return line
+}
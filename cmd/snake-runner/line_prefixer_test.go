@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinePrefixer(t *testing.T) {
+	test := assert.New(t)
+
+	text := "first\nsecond line\n\nunfinished"
+
+	for _, chunkSize := range []int{1, 3, 7, 1024} {
+		prefixer := NewLinePrefixer("[GO=1.15] ")
+
+		output := ""
+		for rest := text; len(rest) > 0; {
+			size := chunkSize
+			if size > len(rest) {
+				size = len(rest)
+			}
+
+			output += prefixer.Write(rest[:size])
+			rest = rest[size:]
+		}
+
+		test.Equal(
+			"[GO=1.15] first\n[GO=1.15] second line\n[GO=1.15] \n",
+			output,
+			"chunk size: %d", chunkSize,
+		)
+		test.Equal("[GO=1.15] unfinished\n", prefixer.Flush())
+		test.Empty(prefixer.Flush())
+	}
+}
@@ -13,21 +13,28 @@ var (
 	DefaultLogsBufferTimeout = time.Second * 2
 )
 
+// LogsBufferedWriter buffers logs and flushes them by size or by timeout,
+// secrets are masked before the logs get into the buffer.
+//
 //go:generate gonstructor -type LogsBufferedWriter -init init
 type LogsBufferedWriter struct {
 	thread   sync.WaitGroup `gonstructor:"-"`
 	size     int
 	duration time.Duration
+	masker   *Masker
 	flush    func(text string)
 	pipe     chan string `gonstructor:"-"`
 }
 
 func (writer *LogsBufferedWriter) init() {
 	writer.pipe = make(chan string, 128 /* ?? */)
+
+	// added here instead of Run, otherwise Wait can return before Run is
+	// even started
+	writer.thread.Add(1)
 }
 
 func (writer *LogsBufferedWriter) Run() {
-	writer.thread.Add(1)
 	defer writer.thread.Done()
 
 	ticker := utils.NewTicker(writer.duration)
@@ -36,10 +43,11 @@ func (writer *LogsBufferedWriter) Run() {
 		select {
 		case item, ok := <-writer.pipe:
 			if !ok {
+				buffer.WriteString(writer.masker.Flush())
 				writer.flush(buffer.String())
 				return
 			}
-			buffer.WriteString(item)
+			buffer.WriteString(writer.masker.Write(item))
 			if buffer.Len() >= writer.size {
 				writer.flush(buffer.String())
 				buffer.Reset()
@@ -4,8 +4,8 @@ package main
 
 import "time"
 
-func NewLogsBufferedWriter(size int, duration time.Duration, flush func(text string)) *LogsBufferedWriter {
-	r := &LogsBufferedWriter{size: size, duration: duration, flush: flush}
+func NewLogsBufferedWriter(size int, duration time.Duration, masker *Masker, flush func(text string)) *LogsBufferedWriter {
+	r := &LogsBufferedWriter{size: size, duration: duration, masker: masker, flush: flush}
 	r.init()
 	return r
 }
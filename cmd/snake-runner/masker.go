@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	// MaskedValue replaces values of secret variables in logs.
+	MaskedValue = "[masked]"
+
+	// MinMaskedLength is a minimal length of masked values, shorter values
+	// would mask too much of ordinary output.
+	MinMaskedLength = 4
+)
+
+// Masker replaces values of secret variables in a stream of logs, the values
+// are also masked in base64 and URL-encoded forms.
+//
+// The stream can be split at any place, so the masker holds back the end of
+// the written text if it can be a beginning of a secret value.
+type Masker struct {
+	values  []string
+	pending string
+}
+
+func NewMasker(secrets []string) *Masker {
+	unique := map[string]bool{}
+	for _, secret := range secrets {
+		// multiline values like private keys are masked line by line since
+		// terminal can replace line endings
+		for _, line := range append([]string{secret}, strings.Split(secret, "\n")...) {
+			line = strings.TrimRight(line, "\r")
+			if len(line) < MinMaskedLength {
+				continue
+			}
+
+			for _, value := range getEncodedForms(line) {
+				if len(value) >= MinMaskedLength {
+					unique[value] = true
+				}
+			}
+		}
+	}
+
+	masker := &Masker{}
+	for value := range unique {
+		masker.values = append(masker.values, value)
+	}
+
+	// longer values first, so a value containing another value is masked
+	// entirely
+	sort.Slice(masker.values, func(i, j int) bool {
+		if len(masker.values[i]) != len(masker.values[j]) {
+			return len(masker.values[i]) > len(masker.values[j])
+		}
+
+		return masker.values[i] < masker.values[j]
+	})
+
+	return masker
+}
+
+// Write returns the given text with masked secrets, a part of the text can be
+// returned by next calls of Write or by Flush.
+func (masker *Masker) Write(text string) string {
+	if len(masker.values) == 0 {
+		return text
+	}
+
+	data := masker.mask(masker.pending + text)
+
+	keep := 0
+	for _, value := range masker.values {
+		for size := len(value) - 1; size > keep; size-- {
+			if strings.HasSuffix(data, value[:size]) {
+				keep = size
+				break
+			}
+		}
+	}
+
+	masker.pending = data[len(data)-keep:]
+
+	return data[:len(data)-keep]
+}
+
+// Flush returns the text which has been held back, it's the end of the
+// stream, so the held back beginning of a secret is masked too unless it's
+// too short to be told apart from ordinary output.
+func (masker *Masker) Flush() string {
+	pending := masker.pending
+	masker.pending = ""
+
+	if len(pending) < MinMaskedLength {
+		return pending
+	}
+
+	for _, value := range masker.values {
+		if strings.HasPrefix(value, pending) {
+			return MaskedValue
+		}
+	}
+
+	return pending
+}
+
+func (masker *Masker) mask(text string) string {
+	for _, value := range masker.values {
+		text = strings.ReplaceAll(text, value, MaskedValue)
+	}
+
+	return text
+}
+
+func getEncodedForms(value string) []string {
+	forms := []string{
+		value,
+		url.QueryEscape(value),
+		url.PathEscape(value),
+	}
+
+	// the value can be encoded as a part of a longer string at any offset,
+	// so the value is encoded after 0, 1 and 2 bytes and only characters
+	// which depend on the value alone are used
+	for _, encoding := range []*base64.Encoding{
+		base64.StdEncoding,
+		base64.URLEncoding,
+	} {
+		for shift := 0; shift < 3; shift++ {
+			data := append(make([]byte, shift), value...)
+			encoded := encoding.EncodeToString(data)
+
+			begin := (shift*8 + 5) / 6
+			end := len(data) * 8 / 6
+
+			forms = append(forms, encoded[begin:end])
+		}
+	}
+
+	return forms
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func runMasker(masker *Masker, text string, chunkSize int) string {
+	output := ""
+	for len(text) > 0 {
+		size := chunkSize
+		if size > len(text) {
+			size = len(text)
+		}
+
+		output += masker.Write(text[:size])
+		text = text[size:]
+	}
+
+	return output + masker.Flush()
+}
+
+func TestMaskerMasksSecrets(t *testing.T) {
+	test := assert.New(t)
+
+	secret := "s3cr3t/t0ken+"
+
+	text := "+ curl -H 'Authorization: " + secret + "'\n" +
+		"encoded: " + base64.StdEncoding.EncodeToString([]byte(secret)) + "\n" +
+		"url: https://example.com/?token=" + url.QueryEscape(secret) + "\n" +
+		"not a secret: s3cr\n"
+
+	for _, chunkSize := range []int{1, 3, 7, 1024} {
+		test.Equal(
+			"+ curl -H 'Authorization: [masked]'\n"+
+				"encoded: [masked]w==\n"+
+				"url: https://example.com/?token=[masked]\n"+
+				"not a secret: s3cr\n",
+			runMasker(NewMasker([]string{secret, "x"}), text, chunkSize),
+		)
+	}
+}
+
+func TestMaskerMasksMultilineSecrets(t *testing.T) {
+	test := assert.New(t)
+
+	masker := NewMasker([]string{"first line\nsecond line"})
+
+	test.Equal(
+		"[masked]\r\n[masked]\r\n",
+		runMasker(masker, "first line\r\nsecond line\r\n", 5),
+	)
+}
+
+func TestMaskerWithoutSecrets(t *testing.T) {
+	test := assert.New(t)
+
+	masker := NewMasker(nil)
+
+	test.Equal("text", masker.Write("text"))
+	test.Equal("", masker.Flush())
+}
+
+func TestMaskerMasksShiftedBase64(t *testing.T) {
+	test := assert.New(t)
+
+	secret := "s3cr3t/t0ken+"
+
+	for _, prefix := range []string{"", "u", "us", "user:"} {
+		encoded := base64.StdEncoding.EncodeToString([]byte(prefix + secret))
+
+		output := runMasker(NewMasker([]string{secret}), encoded, 1024)
+
+		test.Contains(output, MaskedValue, prefix)
+		test.NotContains(output, encoded[len(encoded)-8:], prefix)
+	}
+}
+
+func TestMaskerMasksPrefixOnFlush(t *testing.T) {
+	test := assert.New(t)
+
+	masker := NewMasker([]string{"s3cr3t/t0ken+"})
+
+	test.Equal("token: ", masker.Write("token: s3cr3t/t0"))
+	test.Equal(MaskedValue, masker.Flush())
+	test.Equal("", masker.Flush())
+}
+
+func TestMaskerKeepsShortPrefixOnFlush(t *testing.T) {
+	test := assert.New(t)
+
+	masker := NewMasker([]string{"s3cr3t"})
+
+	test.Equal("running test", masker.Write("running tests"))
+	test.Equal("s", masker.Flush())
+
+	test.Equal(
+		"running tests",
+		runMasker(NewMasker([]string{"s3cr3t"}), "running tests", 1),
+	)
+}
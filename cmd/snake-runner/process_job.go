@@ -2,15 +2,17 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"os"
+	"sort"
 	"strings"
+	"sync"
 
-	"github.com/docker/docker/api/types"
 	"github.com/reconquest/cog"
 	"github.com/reconquest/karma-go"
-	"github.com/reconquest/snake-runner/internal/cloud"
 	"github.com/reconquest/snake-runner/internal/config"
+	"github.com/reconquest/snake-runner/internal/executor"
 	"github.com/reconquest/snake-runner/internal/sidecar"
 	"github.com/reconquest/snake-runner/internal/snake"
 	"github.com/reconquest/snake-runner/internal/tasks"
@@ -19,35 +21,60 @@ import (
 
 const (
 	DefaultImage = "alpine:latest"
+
+	// FilesTmpfsOptions are options of the tmpfs with file variables, the
+	// container can run as any user, so the directory is writable by anyone
+	// while the files themselves are private.
+	FilesTmpfsOptions = "rw,noexec,nosuid,mode=1777"
+
+	// WriteFileScript writes a file variable with 0600 permissions.
+	WriteFileScript = `umask 077 && printf '%s' "$__SNAKE_FILE_CONTENT" > "$__SNAKE_FILE_PATH"`
 )
 
 //go:generate gonstructor -type ProcessJob -init init
 type ProcessJob struct {
 	ctx          context.Context
-	cloud        *cloud.Cloud
+	executor     executor.Executor
 	client       *Client
 	config       config.Pipeline
 	runnerConfig *RunnerConfig
 
 	task        tasks.PipelineRun
-	utilization chan *cloud.Container
+	utilization chan *executor.Container
 
 	job snake.PipelineJob
 	log *cog.Logger
 
 	configJob config.Job `gonstructor:"-"`
 
-	container  *cloud.Container    `gonstructor:"-"`
-	sidecar    *sidecar.Sidecar    `gonstructor:"-"`
-	shell      string              `gonstructor:"-"`
-	env        Env                 `gonstructor:"-"`
-	logsWriter *LogsBufferedWriter `gonstructor:"-"`
+	container  *executor.Container   `gonstructor:"-"`
+	services   []*executor.Container `gonstructor:"-"`
+	network    *executor.Network     `gonstructor:"-"`
+	sidecar    *sidecar.Sidecar      `gonstructor:"-"`
+	shell      string                `gonstructor:"-"`
+	env        Env                   `gonstructor:"-"`
+	logsWriter *LogsBufferedWriter   `gonstructor:"-"`
+	cacheKey   string                `gonstructor:"-"`
+	mergeBase  string                `gonstructor:"-"`
+	timedOut   bool                  `gonstructor:"-"`
+	failure    string                `gonstructor:"-"`
+
+	// pipelineNetwork replaces the default network of all containers
+	pipelineNetwork *executor.Network `gonstructor:"-"`
+
+	commit       sidecar.Commit `gonstructor:"-"`
+	changedFiles []string       `gonstructor:"-"`
+
+	// variant is a number of the matrix variant starting from 1, zero means
+	// that the process runs the job itself
+	variant int `gonstructor:"-"`
 }
 
 func (process *ProcessJob) init() {
 	process.logsWriter = NewLogsBufferedWriter(
 		DefaultLogsBufferSize,
 		DefaultLogsBufferTimeout,
+		NewMasker(process.task.GetSecrets()),
 		func(text string) {
 			err := process.client.PushLogs(
 				process.task.Pipeline.ID,
@@ -82,64 +109,713 @@ func (process *ProcessJob) run() error {
 		)
 	}
 
-	process.env = NewEnvBuilder(
-		process.task,
-		process.task.Pipeline,
-		process.job,
-		process.config,
-		process.configJob,
-		process.runnerConfig,
-		process.sidecar.GetContainerDir(),
-	).Build()
+	pipelineCtx := process.ctx
+
+	timeout := process.runnerConfig.GetTimeout(process.configJob.Timeout)
+	if process.configJob.Timeout == 0 {
+		timeout = process.runnerConfig.GetTimeout(process.runnerConfig.JobTimeout)
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		process.ctx, cancel = context.WithTimeout(process.ctx, timeout)
+		defer cancel()
+	}
+
+	var err error
+	variants := process.configJob.GetVariants()
+	if len(variants) > 0 {
+		err = process.executeMatrix(variants)
+	} else {
+		err = process.executeInDir()
+	}
+
+	if err != nil && process.ctx.Err() == context.DeadlineExceeded {
+		process.timedOut = true
+
+		if pipelineCtx.Err() == context.DeadlineExceeded {
+			return process.remoteErrorf(
+				nil,
+				"pipeline exceeded timeout of %s",
+				process.runnerConfig.GetTimeout(process.config.Timeout),
+			)
+		}
+
+		return process.remoteErrorf(nil, "job exceeded timeout of %s", timeout)
+	}
+
+	if err != nil && process.failure == "" {
+		process.failure = config.RetryRunnerSystemFailure
+	}
+
+	return err
+}
+
+// executeInDir runs the job in the repository directory of the pipeline or
+// in its own copy of the directory if the job is isolated, artifacts of
+// needed jobs and the cache are restored to the directory before commands.
+func (process *ProcessJob) executeInDir() error {
+	if process.configJob.Isolated {
+		err := process.sidecar.Copy(process.ctx, process.remoteLog)
+		if err != nil {
+			return process.remoteErrorf(err, "unable to prepare job directory")
+		}
+
+		defer process.sidecar.Destroy()
+	}
+
+	err := process.restoreArtifacts()
+	if err == nil {
+		process.restoreCache()
+
+		err = process.execute()
+	}
+
+	if err == nil {
+		process.saveCache()
+
+		err = process.saveArtifacts()
+	}
+
+	return err
+}
 
+func (process *ProcessJob) execute() error {
 	imageExpr, image := process.getImage()
 
 	process.log.Debugf(nil, "image: %s → %s", imageExpr, image)
 
 	err := process.ensureImage(image)
 	if err != nil {
+		process.failure = config.RetryImagePullFailure
+
 		return process.remoteErrorf(err, "unable to pull image %q", image)
 	}
 
-	process.container, err = process.cloud.CreateContainer(
+	defer process.destroyServices()
+
+	err = process.startServices()
+	if err != nil {
+		return process.remoteErrorf(err, "unable to start services")
+	}
+
+	security, err := process.getSecurity()
+	if err != nil {
+		return process.remoteErrorf(err, "invalid security options")
+	}
+
+	if len(process.env.GetFiles()) > 0 {
+		if process.executor.Type() != executor.TypeDocker {
+			return process.remoteErrorf(
+				fmt.Errorf(
+					"file variables are not supported by %s executor",
+					process.executor.Type(),
+				),
+				"unable to write file variables",
+			)
+		}
+
+		tmpfs := map[string]string{FilesDir: FilesTmpfsOptions}
+		for path, options := range security.Tmpfs {
+			tmpfs[path] = options
+		}
+
+		security.Tmpfs = tmpfs
+	}
+
+	container := executor.ContainerConfig{
+		Image:     image,
+		Name:      process.getContainerName("job"),
+		Volumes:   process.sidecar.GetPipelineVolumes(),
+		Resources: process.getResources(),
+		Security:  security,
+
+		DefaultNetwork: process.getPipelineNetworkName(),
+	}
+
+	if process.network != nil {
+		container.Network = process.network.Name
+	}
+
+	process.container, err = process.executor.CreateContainer(
 		process.ctx,
-		image,
-		fmt.Sprintf(
-			"pipeline-%d-job-%d-uniq-%v",
-			process.task.Pipeline.ID,
-			process.job.ID,
-			utils.RandString(8),
-		),
-		process.sidecar.GetPipelineVolumes(),
+		container,
 	)
 	if err != nil {
 		return process.remoteErrorf(err, "unable to create a container")
 	}
 
-	defer func() {
-		process.utilization <- process.container
-	}()
+	defer process.destroyContainer()
+
+	err = process.writeFiles()
+	if err != nil {
+		return process.remoteErrorf(err, "unable to write file variables")
+	}
 
 	err = process.detectShell()
 	if err != nil {
 		return process.remoteErrorf(err, "unable to detect shell in container")
 	}
 
-	for _, command := range process.configJob.Commands {
-		err = process.execShell(command)
+	if len(process.configJob.Commands) == 0 {
+		return nil
+	}
+
+	script := NewScript(
+		process.configJob.Commands,
+		process.sendPrompt,
+		process.remoteLog,
+	)
+
+	err = process.execScript(script)
+	if err != nil {
+		if karma.Contains(err, executor.ErrNonZeroExitCode) {
+			process.failure = config.RetryScriptFailure
+		}
+
+		if karma.Contains(err, executor.ErrOOMKilled) {
+			process.failure = config.RetryScriptFailure
+
+			process.remoteLog(
+				"\n:: Job was killed because it exceeded memory limit\n",
+			)
+		}
+
+		command, ok := script.GetCurrentCommand()
+		if !ok {
+			return process.remoteErrorf(err, "unable to start commands")
+		}
+
+		return process.remoteErrorf(
+			karma.
+				Describe("cmd", command).
+				Reason(err),
+			"command failed",
+		)
+	}
+
+	return nil
+}
+
+// restoreArtifacts extracts artifacts of all jobs the job needs into the
+// directory of the job.
+func (process *ProcessJob) restoreArtifacts() error {
+	needs := process.config.GetNeeds(process.job.Name)
+
+	keys := []string{}
+	for _, job := range process.task.Jobs {
+		for _, need := range needs {
+			needed := process.config.Jobs[need]
+			if job.Name != need || len(needed.Artifacts.Paths) == 0 {
+				continue
+			}
+
+			variants := len(needed.GetVariants())
+			if variants == 0 {
+				keys = append(keys, getJobKey(job, 0))
+			}
+
+			for variant := 1; variant <= variants; variant++ {
+				keys = append(keys, getJobKey(job, variant))
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	process.remoteLog("\n:: Restoring artifacts\n")
+
+	err := process.sidecar.RestoreArtifacts(process.ctx, keys, process.remoteLog)
+	if err != nil {
+		return process.remoteErrorf(err, "unable to restore artifacts")
+	}
+
+	return nil
+}
+
+func (process *ProcessJob) saveArtifacts() error {
+	paths := process.expandPaths(process.configJob.Artifacts.Paths)
+	if len(paths) == 0 {
+		return nil
+	}
+
+	process.remoteLog(
+		fmt.Sprintf("\n:: Saving artifacts: %s\n", strings.Join(paths, " ")),
+	)
+
+	err := process.sidecar.SaveArtifacts(
+		process.ctx,
+		getJobKey(process.job, process.variant),
+		paths,
+		process.remoteLog,
+	)
+	if err != nil {
+		return process.remoteErrorf(err, "unable to save artifacts")
+	}
+
+	return nil
+}
+
+// getJobKey identifies the job or its matrix variant within the pipeline, it's
+// used as a key of artifacts and a name of the job directory.
+func getJobKey(job snake.PipelineJob, variant int) string {
+	if variant > 0 {
+		return fmt.Sprintf("job-%d-variant-%d", job.ID, variant)
+	}
+
+	return fmt.Sprintf("job-%d", job.ID)
+}
+
+// startServices starts all services of the job in a separate network and
+// waits until they are ready.
+func (process *ProcessJob) startServices() error {
+	services := process.config.GetServices(process.job.Name)
+	if len(services) == 0 {
+		return nil
+	}
+
+	if process.executor.Type() != executor.TypeDocker {
+		return fmt.Errorf(
+			"services are not supported by %s executor",
+			process.executor.Type(),
+		)
+	}
+
+	var err error
+	process.network, err = process.executor.CreateNetwork(
+		process.ctx,
+		process.getContainerName("network"),
+	)
+	if err != nil {
+		return karma.Format(err, "unable to create network for services")
+	}
+
+	for _, service := range services {
+		image := process.env.Expand(service.Image)
+		alias := service.GetAlias()
+
+		err := process.ensureImage(image)
 		if err != nil {
-			return process.remoteErrorf(
-				karma.
-					Describe("cmd", command).
-					Reason(err),
-				"command failed",
+			process.failure = config.RetryImagePullFailure
+
+			return karma.Format(err, "unable to pull image %q", image)
+		}
+
+		env := []string{}
+		for key, value := range service.Variables {
+			env = append(env, key+"="+process.env.Expand(value))
+		}
+
+		container, err := process.executor.CreateContainer(
+			process.ctx,
+			executor.ContainerConfig{
+				Image:     image,
+				Name:      process.getContainerName("service-" + alias),
+				Env:       env,
+				Network:   process.network.Name,
+				Aliases:   []string{alias},
+				Resources: process.runnerConfig.GetResources(executor.Resources{}),
+
+				DefaultNetwork: process.getPipelineNetworkName(),
+			},
+		)
+		if err != nil {
+			return karma.Format(err, "unable to create service %q", alias)
+		}
+
+		process.services = append(process.services, container)
+
+		process.remoteLog(
+			fmt.Sprintf("\n:: Started service: %s as %s\n", image, alias),
+		)
+	}
+
+	for index, container := range process.services {
+		err := process.executor.WaitContainer(process.ctx, container)
+		if err != nil {
+			return karma.Format(
+				err,
+				"service %q is not ready",
+				services[index].GetAlias(),
+			)
+		}
+	}
+
+	return nil
+}
+
+// destroyContainer destroys the job container in background unless it's
+// connected to the network of services or the network of the pipeline, the
+// network can't be removed while the container is still there.
+func (process *ProcessJob) destroyContainer() {
+	if process.network == nil && process.pipelineNetwork == nil {
+		process.utilization <- process.container
+		return
+	}
+
+	err := process.executor.DestroyContainer(
+		context.Background(),
+		process.container,
+	)
+	if err != nil {
+		process.log.Errorf(err, "unable to destroy container of job")
+	}
+}
+
+// destroyServices destroys containers of services and then their network.
+func (process *ProcessJob) destroyServices() {
+	for _, container := range process.services {
+		err := process.executor.DestroyContainer(
+			context.Background(),
+			container,
+		)
+		if err != nil {
+			process.log.Errorf(err, "unable to destroy container of service")
+		}
+	}
+
+	err := process.executor.DestroyNetwork(
+		context.Background(),
+		process.network,
+	)
+	if err != nil {
+		process.log.Errorf(err, "unable to destroy network of services")
+	}
+}
+
+func (process *ProcessJob) getPipelineNetworkName() string {
+	if process.pipelineNetwork == nil {
+		return ""
+	}
+
+	return process.pipelineNetwork.Name
+}
+
+func (process *ProcessJob) getContainerName(kind string) string {
+	return fmt.Sprintf(
+		"pipeline-%d-job-%d-%s-uniq-%v",
+		process.task.Pipeline.ID,
+		process.job.ID,
+		kind,
+		utils.RandString(8),
+	)
+}
+
+// executeMatrix runs all variants of the job at the same time, every variant
+// runs in its own container with its own copy of the repository and saves
+// its own artifacts. Logs of variants are streamed to the job logs, every
+// line is prefixed with variables of its variant.
+func (process *ProcessJob) executeMatrix(variants []map[string]string) error {
+	process.remoteLog(
+		fmt.Sprintf("\n:: running %d variants of the job\n", len(variants)),
+	)
+
+	errs := make([]error, len(variants))
+	failures := make([]string, len(variants))
+
+	workers := &sync.WaitGroup{}
+	for index, variables := range variants {
+		workers.Add(1)
+		go func(index int, variables map[string]string) {
+			defer workers.Done()
+
+			process.remoteLog(
+				fmt.Sprintf(
+					"\n:: variant %d/%d: %s\n",
+					index+1, len(variants), formatVariables(variables),
+				),
 			)
+
+			prefixer := NewLinePrefixer(
+				fmt.Sprintf("[%s] ", formatVariables(variables)),
+			)
+
+			variant := process.newVariant(
+				index+1,
+				variables,
+				func(text string) {
+					lines := prefixer.Write(text)
+					if lines != "" {
+						process.remoteLog(lines)
+					}
+				},
+			)
+
+			variant.env, errs[index] = variant.buildEnv()
+			if errs[index] != nil {
+				variant.remoteErrorf(errs[index], "unable to build variables")
+			} else {
+				errs[index] = variant.executeInDir()
+			}
+
+			failures[index] = variant.failure
+
+			variant.destroy()
+
+			status := "passed"
+			if errs[index] != nil {
+				status = "failed"
+			}
+
+			process.remoteLog(
+				fmt.Sprintf(
+					"%s:: variant %d/%d: %s %s\n",
+					prefixer.Flush(),
+					index+1, len(variants), formatVariables(variables),
+					status,
+				),
+			)
+		}(index, variables)
+	}
+
+	workers.Wait()
+
+	failed := 0
+	for index, err := range errs {
+		if err == nil {
+			continue
 		}
+
+		if failed == 0 {
+			process.failure = failures[index]
+		}
+
+		failed++
+	}
+
+	if failed > 0 {
+		return process.remoteErrorf(
+			nil,
+			"%d of %d variants of the job failed",
+			failed, len(variants),
+		)
 	}
 
 	return nil
 }
 
+// newVariant returns a copy of the job process which runs with given matrix
+// variables in its own copy of the repository and passes logs to given
+// function instead of the remote server.
+func (process *ProcessJob) newVariant(
+	number int,
+	variables map[string]string,
+	flush func(text string),
+) *ProcessJob {
+	variant := &ProcessJob{
+		ctx:          process.ctx,
+		executor:     process.executor,
+		client:       process.client,
+		config:       process.config,
+		runnerConfig: process.runnerConfig,
+		task:         process.task,
+		utilization:  process.utilization,
+		job:          process.job,
+		log: process.log.NewChildWithPrefix(
+			fmt.Sprintf("[variant: %s]", formatVariables(variables)),
+		),
+		configJob: process.configJob,
+		sidecar:   process.sidecar.Fork(getJobKey(process.job, number)),
+		mergeBase: process.mergeBase,
+		variant:   number,
+
+		pipelineNetwork: process.pipelineNetwork,
+
+		commit:       process.commit,
+		changedFiles: process.changedFiles,
+	}
+
+	// variants run at the same time, so they can't share the directory
+	variant.configJob.Parallel = config.Parallel{}
+	variant.configJob.Isolated = true
+	variant.configJob.Variables = map[string]string{}
+	for key, value := range process.configJob.Variables {
+		variant.configJob.Variables[key] = value
+	}
+
+	for key, value := range variables {
+		variant.configJob.Variables[key] = value
+	}
+
+	variant.logsWriter = NewLogsBufferedWriter(
+		DefaultLogsBufferSize,
+		DefaultLogsBufferTimeout,
+		NewMasker(process.task.GetSecrets()),
+		flush,
+	)
+
+	go variant.logsWriter.Run()
+
+	return variant
+}
+
+func formatVariables(variables map[string]string) string {
+	keys := []string{}
+	for key := range variables {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+variables[key])
+	}
+
+	return strings.Join(pairs, " ")
+}
+
+func (process *ProcessJob) buildEnv() (Env, error) {
+	return NewEnvBuilder(
+		process.task,
+		process.task.Pipeline,
+		process.job,
+		process.config,
+		process.configJob,
+		process.runnerConfig,
+		process.sidecar.GetContainerDir(),
+		process.mergeBase,
+		process.commit,
+		process.changedFiles,
+	).Build()
+}
+
+// restoreCache extracts the cache of the job into the repository directory,
+// the job can run without cache, so errors are only reported to the log.
+func (process *ProcessJob) restoreCache() {
+	if len(process.configJob.Cache.Paths) == 0 {
+		return
+	}
+
+	var err error
+	process.cacheKey, err = process.getCacheKey()
+	if err != nil {
+		process.remoteErrorf(err, "unable to get cache key, cache is disabled")
+		return
+	}
+
+	found, err := process.sidecar.RestoreCache(
+		process.ctx,
+		process.cacheKey,
+		process.remoteLog,
+	)
+	if err != nil {
+		process.remoteErrorf(err, "unable to restore cache")
+		return
+	}
+
+	if found {
+		process.remoteLog(
+			fmt.Sprintf("\n:: Restored cache: %s\n", process.cacheKey),
+		)
+	} else {
+		process.remoteLog(
+			fmt.Sprintf("\n:: Cache not found: %s\n", process.cacheKey),
+		)
+	}
+}
+
+func (process *ProcessJob) saveCache() {
+	if process.cacheKey == "" {
+		return
+	}
+
+	process.remoteLog(
+		fmt.Sprintf("\n:: Saving cache: %s\n", process.cacheKey),
+	)
+
+	err := process.sidecar.SaveCache(
+		process.ctx,
+		process.cacheKey,
+		process.expandPaths(process.configJob.Cache.Paths),
+		process.remoteLog,
+	)
+	if err != nil {
+		process.remoteErrorf(err, "unable to save cache")
+		return
+	}
+
+	if process.runnerConfig.CacheMaxSizeMB == 0 {
+		return
+	}
+
+	removed, err := process.sidecar.PruneCache(
+		process.ctx,
+		process.runnerConfig.CacheMaxSizeMB*1024*1024,
+	)
+	if err != nil {
+		process.log.Errorf(err, "unable to prune cache")
+		process.remoteErrorf(err, "unable to prune cache")
+	}
+
+	for _, path := range removed {
+		process.log.Debugf(nil, "cache removed: %s", path)
+	}
+}
+
+// getCacheKey returns a hash of the cache key and checksum of the cache
+// files, the job name is used if no key specified.
+func (process *ProcessJob) getCacheKey() (string, error) {
+	key := process.env.Expand(process.configJob.Cache.Key)
+	if key == "" {
+		key = process.job.Name
+	}
+
+	checksum := ""
+	if len(process.configJob.Cache.Files) > 0 {
+		var err error
+		checksum, err = process.sidecar.Checksum(
+			process.ctx,
+			process.expandPaths(process.configJob.Cache.Files),
+		)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	hash := sha256.Sum256([]byte(key + "\n" + checksum))
+
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func (process *ProcessJob) getPullPolicy() executor.PullPolicy {
+	if process.configJob.PullPolicy != "" {
+		return process.configJob.PullPolicy
+	}
+
+	return process.runnerConfig.Docker.PullPolicy
+}
+
+// getResources returns resources requested by the job limited by the runner.
+func (process *ProcessJob) getResources() executor.Resources {
+	requested := process.configJob.Resources
+
+	return process.runnerConfig.GetResources(executor.Resources{
+		CPUs:    requested.CPUs,
+		Memory:  int64(requested.Memory),
+		Pids:    requested.Pids,
+		ShmSize: int64(requested.ShmSize),
+	})
+}
+
+// getSecurity returns security options of the runner with options requested
+// by the job if the runner allows them.
+func (process *ProcessJob) getSecurity() (executor.Security, error) {
+	requested := process.configJob.Security
+
+	return process.runnerConfig.GetSecurity(executor.Security{
+		Privileged:  requested.Privileged,
+		CapAdd:      requested.CapAdd,
+		CapDrop:     requested.CapDrop,
+		SecurityOpt: requested.SecurityOpt,
+		ReadOnly:    requested.ReadOnly,
+		Tmpfs:       requested.GetTmpfs(),
+		User:        requested.User,
+	})
+}
+
 func (process *ProcessJob) getImage() (string, string) {
 	var image string
 	switch {
@@ -151,16 +827,19 @@ func (process *ProcessJob) getImage() (string, string) {
 		image = DefaultImage
 	}
 
-	expanded := process.expandEnv(image)
+	expanded := process.env.Expand(image)
 
 	return image, expanded
 }
 
-func (process *ProcessJob) expandEnv(target string) string {
-	return os.Expand(target, func(name string) string {
-		value, _ := process.env.Get(name)
-		return value
-	})
+// expandPaths expands variables in paths of artifacts and cache.
+func (process *ProcessJob) expandPaths(paths []string) []string {
+	expanded := []string{}
+	for _, path := range paths {
+		expanded = append(expanded, process.env.Expand(path))
+	}
+
+	return expanded
 }
 
 func (process *ProcessJob) remoteLog(text string) {
@@ -178,20 +857,20 @@ func (process *ProcessJob) remoteErrorf(
 	return err
 }
 
-func (process *ProcessJob) execShell(cmd string) error {
-	process.sendPrompt([]string{cmd})
+func (process *ProcessJob) execScript(script *Script) error {
+	defer script.Flush()
 
-	err := process.cloud.Exec(
+	err := process.executor.Exec(
 		process.ctx,
 		process.container,
-		types.ExecConfig{
+		executor.ExecConfig{
 			Env:          process.env.GetAll(),
 			WorkingDir:   process.sidecar.GetContainerDir(),
-			Cmd:          []string{process.shell, "-c", cmd},
+			Cmd:          []string{process.shell, "-c", script.String()},
 			AttachStdout: true,
 			AttachStderr: true,
 		},
-		process.remoteLog,
+		script.Write,
 	)
 
 	return err
@@ -201,6 +880,32 @@ func (process *ProcessJob) sendPrompt(cmd []string) {
 	process.remoteLog("\n$ " + strings.Join(cmd, " ") + "\n")
 }
 
+// writeFiles writes file variables to the tmpfs of the container, the files
+// are gone as soon as the container is destroyed.
+func (process *ProcessJob) writeFiles() error {
+	for path, content := range process.env.GetFiles() {
+		err := process.executor.Exec(
+			process.ctx,
+			process.container,
+			executor.ExecConfig{
+				Cmd: []string{"sh", "-c", WriteFileScript},
+				Env: []string{
+					"__SNAKE_FILE_PATH=" + path,
+					"__SNAKE_FILE_CONTENT=" + content,
+				},
+				AttachStdout: true,
+				AttachStderr: true,
+			},
+			process.remoteLog,
+		)
+		if err != nil {
+			return karma.Format(err, "unable to write file %s", path)
+		}
+	}
+
+	return nil
+}
+
 func (process *ProcessJob) detectShell() error {
 	if process.config.Shell != "" {
 		process.log.Debugf(
@@ -208,7 +913,7 @@ func (process *ProcessJob) detectShell() error {
 			"using shell specified in pipeline spec: %q",
 			process.config.Shell,
 		)
-		process.shell = process.config.Shell
+		process.shell = process.env.Expand(process.config.Shell)
 		return nil
 	}
 
@@ -218,7 +923,7 @@ func (process *ProcessJob) detectShell() error {
 			"using shell specified in job spec: %q",
 			process.configJob.Shell,
 		)
-		process.shell = process.configJob.Shell
+		process.shell = process.env.Expand(process.configJob.Shell)
 		return nil
 	}
 
@@ -240,10 +945,10 @@ func (process *ProcessJob) detectShell() error {
 
 	cmd := []string{"sh", "-c", DETECT_SHELL_COMMAND}
 
-	err := process.cloud.Exec(
+	err := process.executor.Exec(
 		process.ctx,
 		process.container,
-		types.ExecConfig{
+		executor.ExecConfig{
 			Cmd:          cmd,
 			AttachStdout: true,
 			AttachStderr: true,
@@ -275,39 +980,26 @@ func (process *ProcessJob) detectShell() error {
 }
 
 func (process *ProcessJob) ensureImage(tag string) error {
-	if !strings.Contains(tag, ":") {
-		tag = tag + ":latest"
-	}
-
-	image, err := process.cloud.GetImageWithTag(process.ctx, tag)
+	image, err := process.executor.EnsureImage(
+		process.ctx,
+		tag,
+		process.getPullPolicy(),
+		process.task.Registries,
+		process.remoteLog,
+	)
 	if err != nil {
 		return err
 	}
 
 	if image == nil {
-		process.remoteLog(
-			fmt.Sprintf("\n:: pulling docker image: %s\n", tag),
-		)
-
-		err := process.cloud.PullImage(process.ctx, tag, process.remoteLog)
-		if err != nil {
-			return err
-		}
-
-		image, err = process.cloud.GetImageWithTag(process.ctx, tag)
-		if err != nil {
-			return karma.Format(err, "unable to get image after pulling")
-		}
-
-		if image == nil {
-			return karma.Format(err, "image not found after pulling")
-		}
+		// the executor doesn't use images at all
+		return nil
 	}
 
 	process.remoteLog(
 		fmt.Sprintf(
 			"\n:: Using docker image: %s @ %s\n",
-			strings.Join(image.RepoTags, ", "),
+			strings.Join(image.Tags, ", "),
 			image.ID,
 		),
 	)
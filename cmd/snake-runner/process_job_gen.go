@@ -6,14 +6,14 @@ import (
 	"context"
 
 	"github.com/reconquest/cog"
-	"github.com/reconquest/snake-runner/internal/cloud"
 	"github.com/reconquest/snake-runner/internal/config"
+	"github.com/reconquest/snake-runner/internal/executor"
 	"github.com/reconquest/snake-runner/internal/snake"
 	"github.com/reconquest/snake-runner/internal/tasks"
 )
 
-func NewProcessJob(ctx context.Context, cloud *cloud.Cloud, client *Client, config config.Pipeline, runnerConfig *RunnerConfig, task tasks.PipelineRun, utilization chan *cloud.Container, job snake.PipelineJob, log *cog.Logger) *ProcessJob {
-	r := &ProcessJob{ctx: ctx, cloud: cloud, client: client, config: config, runnerConfig: runnerConfig, task: task, utilization: utilization, job: job, log: log}
+func NewProcessJob(ctx context.Context, executor executor.Executor, client *Client, config config.Pipeline, runnerConfig *RunnerConfig, task tasks.PipelineRun, utilization chan *executor.Container, job snake.PipelineJob, log *cog.Logger) *ProcessJob {
+	r := &ProcessJob{ctx: ctx, executor: executor, client: client, config: config, runnerConfig: runnerConfig, task: task, utilization: utilization, job: job, log: log}
 	r.init()
 	return r
 }
@@ -4,19 +4,19 @@ import (
 	"context"
 	"fmt"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/reconquest/cog"
 	"github.com/reconquest/karma-go"
 	"github.com/reconquest/pkg/log"
-	"github.com/reconquest/snake-runner/internal/cloud"
 	"github.com/reconquest/snake-runner/internal/config"
+	"github.com/reconquest/snake-runner/internal/executor"
 	"github.com/reconquest/snake-runner/internal/ptr"
 	"github.com/reconquest/snake-runner/internal/sidecar"
 	"github.com/reconquest/snake-runner/internal/snake"
 	"github.com/reconquest/snake-runner/internal/sshkey"
-	"github.com/reconquest/snake-runner/internal/syncdo"
 	"github.com/reconquest/snake-runner/internal/tasks"
 	"github.com/reconquest/snake-runner/internal/utils"
 )
@@ -32,23 +32,34 @@ type ProcessPipeline struct {
 	client       *Client
 	runnerConfig *RunnerConfig
 	task         tasks.PipelineRun
-	cloud        *cloud.Cloud
+	executor     executor.Executor
 	log          *cog.Logger
-	utilization  chan *cloud.Container
-
-	status      string           `gonstructor:"-"`
-	sidecar     *sidecar.Sidecar `gonstructor:"-"`
-	initSidecar syncdo.Action    `gonstructor:"-"`
-	config      config.Pipeline  `gonstructor:"-"`
+	utilization  chan *executor.Container
+
+	status        string                `gonstructor:"-"`
+	sidecar       *sidecar.Sidecar      `gonstructor:"-"`
+	network       *executor.Network     `gonstructor:"-"`
+	config        config.Pipeline       `gonstructor:"-"`
+	stages        [][]snake.PipelineJob `gonstructor:"-"`
+	skipped       map[int]bool          `gonstructor:"-"`
+	mergeBase     string                `gonstructor:"-"`
+	commit        sidecar.Commit        `gonstructor:"-"`
+	changedFiles  []string              `gonstructor:"-"`
+	envs          map[int]Env           `gonstructor:"-"`
+	startedAt     time.Time             `gonstructor:"-"`
+	cancelTimeout context.CancelFunc    `gonstructor:"-"`
 
 	sshKey sshkey.Key
 
-	onceFail sync.Once `gonstructor:"-"`
+	onceFail sync.Once  `gonstructor:"-"`
+	mutex    sync.Mutex `gonstructor:"-"`
 }
 
 func (process *ProcessPipeline) run() error {
 	defer process.destroy()
 
+	process.startedAt = utils.Now()
+
 	process.log.Infof(nil, "pipeline started")
 
 	defer func() {
@@ -70,6 +81,13 @@ func (process *ProcessPipeline) run() error {
 		)
 	}
 
+	err = process.prepare()
+	if err != nil {
+		process.fail(FailAllJobs)
+
+		return err
+	}
+
 	process.status, err = process.runJobs()
 	if err != nil {
 		return err
@@ -93,23 +111,69 @@ func (process *ProcessPipeline) run() error {
 	return nil
 }
 
-func (process *ProcessPipeline) splitJobs() [][]snake.PipelineJob {
-	stages := []string{}
+// prepare clones the repository and reads the pipeline config, output goes
+// to the log of the first job since pipelines have no logs on their own.
+func (process *ProcessPipeline) prepare() error {
+	if len(process.task.Jobs) == 0 {
+		return fmt.Errorf("pipeline has no jobs")
+	}
+
+	job := process.newProcessJob(process.task.Jobs[0])
+	defer job.destroy()
+
+	err := process.createNetwork()
+	if err != nil {
+		return job.remoteErrorf(
+			err,
+			"unable to create network for pipeline",
+		)
+	}
+
+	err = process.readConfig(job)
+	if err != nil {
+		return job.remoteErrorf(
+			err,
+			"unable to read config file",
+		)
+	}
+
+	process.stages, err = process.splitJobs()
+	if err == nil {
+		err = process.checkNeeds()
+	}
+	if err == nil {
+		process.envs, err = process.buildEnvs()
+	}
+	if err != nil {
+		return job.remoteErrorf(
+			err,
+			"invalid pipeline config: %q",
+			process.task.Pipeline.Filename,
+		)
+	}
+
+	return nil
+}
+
+// splitJobs groups jobs by stages in order the stages are declared in the
+// config.
+func (process *ProcessPipeline) splitJobs() ([][]snake.PipelineJob, error) {
+	declared := map[string]bool{}
+	for _, stage := range process.config.Stages {
+		declared[stage] = true
+	}
+
 	for _, job := range process.task.Jobs {
-		found := false
-		for _, stage := range stages {
-			if stage == job.Stage {
-				found = true
-				break
-			}
-		}
-		if !found {
-			stages = append(stages, job.Stage)
+		if !declared[job.Stage] {
+			return nil, fmt.Errorf(
+				"job %q refers to stage %q which is not declared in stages",
+				job.Name, job.Stage,
+			)
 		}
 	}
 
 	result := [][]snake.PipelineJob{}
-	for _, stage := range stages {
+	for _, stage := range process.config.Stages {
 		stageJobs := []snake.PipelineJob{}
 
 		for _, job := range process.task.Jobs {
@@ -118,10 +182,17 @@ func (process *ProcessPipeline) splitJobs() [][]snake.PipelineJob {
 			}
 		}
 
+		if len(stageJobs) == 0 {
+			return nil, fmt.Errorf(
+				"stage %q is declared in stages but has no jobs",
+				stage,
+			)
+		}
+
 		result = append(result, stageJobs)
 	}
 
-	return result
+	return result, nil
 }
 
 func (process *ProcessPipeline) runJobs() (string, error) {
@@ -129,37 +200,163 @@ func (process *ProcessPipeline) runJobs() (string, error) {
 	var resultStatus string
 	var resultErr error
 
-	total := len(process.task.Jobs)
-	index := 0
-	for _, stageJobs := range process.splitJobs() {
-		workers := &sync.WaitGroup{}
-
-		for _, job := range stageJobs {
-			index++
-			workers.Add(1)
-			go func(index int, job snake.PipelineJob) {
-				defer workers.Done()
-
-				status, err := process.runJob(total, index, job)
-				if err != nil {
-					once.Do(func() {
-						resultStatus = status
-						resultErr = err
-
-						process.fail(job.ID)
-					})
+	jobs := process.getJobs()
+
+	done := map[string]chan struct{}{}
+	for _, job := range jobs {
+		done[job.Name] = make(chan struct{})
+	}
+
+	workers := &sync.WaitGroup{}
+	for index, job := range jobs {
+		workers.Add(1)
+		go func(index int, job snake.PipelineJob) {
+			defer workers.Done()
+			defer close(done[job.Name])
+
+			// the job starts as soon as all jobs it needs are finished, if
+			// any of them has failed then the job is already skipped
+			for _, need := range process.config.GetNeeds(job.Name) {
+				<-done[need]
+			}
+
+			if utils.Done(process.ctx) {
+				process.skip(job)
+			}
+
+			if !process.isSkipped(job) && !process.isIncluded(job) {
+				process.log.Infof(
+					nil,
+					"job=%d doesn't match rules of the job, skipping",
+					job.ID,
+				)
+
+				process.exclude(job)
+			}
+
+			if process.isSkipped(job) {
+				return
+			}
+
+			status, err := process.runJob(len(jobs), index+1, job)
+			if err != nil {
+				if process.isFailureAllowed(job, status) {
+					process.log.Warningf(
+						err,
+						"job=%d failed but it is allowed to fail",
+						job.ID,
+					)
+					return
 				}
-			}(index, job)
+
+				once.Do(func() {
+					resultStatus = status
+					resultErr = err
+				})
+
+				process.fail(job.ID)
+			}
+		}(index, job)
+	}
+
+	workers.Wait()
+
+	if resultErr != nil {
+		process.failPipeline()
+
+		return resultStatus, resultErr
+	}
+
+	return StatusSuccess, nil
+}
+
+// getJobs returns jobs in order of stages.
+func (process *ProcessPipeline) getJobs() []snake.PipelineJob {
+	if process.stages == nil {
+		return process.task.Jobs
+	}
+
+	jobs := []snake.PipelineJob{}
+	for _, stageJobs := range process.stages {
+		jobs = append(jobs, stageJobs...)
+	}
+
+	return jobs
+}
+
+// checkNeeds makes sure that all jobs of the pipeline are described in the
+// config and all jobs which are needed by other jobs are going to be run in
+// the pipeline, otherwise jobs would wait for each other forever.
+func (process *ProcessPipeline) checkNeeds() error {
+	names := map[string]bool{}
+	for _, job := range process.task.Jobs {
+		names[job.Name] = true
+	}
+
+	for _, job := range process.task.Jobs {
+		if _, ok := process.config.Jobs[job.Name]; !ok {
+			return fmt.Errorf(
+				"unable to find given job %q in %q",
+				job.Name,
+				process.task.Pipeline.Filename,
+			)
 		}
 
-		workers.Wait()
+		for _, need := range process.config.GetNeeds(job.Name) {
+			if !names[need] {
+				return fmt.Errorf(
+					"job %q needs job %q which is not in the pipeline",
+					job.Name, need,
+				)
+			}
+		}
+	}
 
-		if resultErr != nil {
-			return resultStatus, resultErr
+	return nil
+}
+
+// getDependents returns all jobs which directly or indirectly need the
+// given job. If explicit is true then only jobs listed in 'needs' are taken
+// into account, not the implicit dependencies on previous stages.
+func (process *ProcessPipeline) getDependents(
+	id int,
+	explicit bool,
+) []snake.PipelineJob {
+	jobs := process.getJobs()
+
+	failed := map[string]bool{}
+	for _, job := range jobs {
+		if job.ID == id {
+			failed[job.Name] = true
 		}
 	}
 
-	return StatusSuccess, nil
+	dependents := []snake.PipelineJob{}
+	for changed := true; changed; {
+		changed = false
+
+		for _, job := range jobs {
+			if failed[job.Name] {
+				continue
+			}
+
+			needs := process.config.GetNeeds(job.Name)
+			if explicit {
+				needs = process.config.Jobs[job.Name].Needs
+			}
+
+			for _, need := range needs {
+				if failed[need] {
+					failed[job.Name] = true
+					dependents = append(dependents, job)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	return dependents
 }
 
 func (process *ProcessPipeline) runJob(total, index int, job snake.PipelineJob) (string, error) {
@@ -213,7 +410,25 @@ func (process *ProcessPipeline) runJob(total, index int, job snake.PipelineJob)
 	return status, nil
 }
 
-func (process *ProcessPipeline) processJob(target snake.PipelineJob) (status string, err error) {
+func (process *ProcessPipeline) processJob(target snake.PipelineJob) (string, error) {
+	for attempt := 1; ; attempt++ {
+		status, retry, err := process.processJobAttempt(target, attempt)
+		if !retry {
+			return status, err
+		}
+
+		process.log.Warningf(
+			err,
+			"job=%d attempt %d failed, retrying",
+			target.ID, attempt,
+		)
+	}
+}
+
+func (process *ProcessPipeline) processJobAttempt(
+	target snake.PipelineJob,
+	attempt int,
+) (status string, retry bool, err error) {
 	defer func() {
 		tears := recover()
 		if tears != nil {
@@ -225,9 +440,71 @@ func (process *ProcessPipeline) processJob(target snake.PipelineJob) (status str
 		}
 	}()
 
-	job := NewProcessJob(
+	job := process.newProcessJob(target)
+	defer job.destroy()
+
+	policy := process.config.Jobs[target.Name].Retry
+	if policy.Attempts > 1 {
+		job.remoteLog(
+			fmt.Sprintf("\n:: attempt %d/%d\n", attempt, policy.Attempts),
+		)
+	}
+
+	job.sidecar = process.getJobSidecar(target)
+	job.env = process.envs[target.ID]
+	job.mergeBase = process.mergeBase
+	job.commit = process.commit
+	job.changedFiles = process.changedFiles
+	job.pipelineNetwork = process.network
+
+	err = job.run()
+	if err != nil {
+		status := StatusFailed
+
+		switch {
+		case job.timedOut:
+			status = StatusTimeout
+
+		case utils.IsCanceled(err):
+			// special case when runner gets terminated
+			if utils.Done(process.parentCtx) {
+				job.remoteLog("\n\nWARNING: snake-runner has been terminated")
+
+				return StatusFailed, false, err
+			}
+
+			return StatusCanceled, false, err
+		}
+
+		if process.isRetryable(target, attempt, job.failure) {
+			job.remoteLog(
+				fmt.Sprintf(
+					"\n\n:: attempt %d/%d failed, "+
+						"the job will be retried in a fresh container\n",
+					attempt, policy.Attempts,
+				),
+			)
+
+			return status, true, err
+		}
+
+		if process.isFailureAllowed(target, status) {
+			job.remoteLog(
+				"\n\nWARNING: job failed, but it is allowed to fail, " +
+					"the pipeline will continue",
+			)
+		}
+
+		return status, false, err
+	}
+
+	return StatusSuccess, false, nil
+}
+
+func (process *ProcessPipeline) newProcessJob(target snake.PipelineJob) *ProcessJob {
+	return NewProcessJob(
 		process.ctx,
-		process.cloud,
+		process.executor,
 		process.client,
 		process.config,
 		process.runnerConfig,
@@ -242,148 +519,304 @@ func (process *ProcessPipeline) processJob(target snake.PipelineJob) (status str
 			),
 		),
 	)
-	defer job.destroy()
+}
 
-	err = process.readConfig(job)
+// isRetryable returns true if the failed attempt of the job should be
+// retried, the failure is empty if the reason is unknown, e.g. a timeout.
+func (process *ProcessPipeline) isRetryable(
+	job snake.PipelineJob,
+	attempt int,
+	failure string,
+) bool {
+	policy := process.config.Jobs[job.Name].Retry
+
+	return attempt < policy.Attempts &&
+		policy.Allows(failure) &&
+		!utils.Done(process.ctx)
+}
+
+func (process *ProcessPipeline) isFailureAllowed(
+	job snake.PipelineJob,
+	status string,
+) bool {
+	if status != StatusFailed && status != StatusTimeout {
+		return false
+	}
+
+	// the runner has been terminated, it's not a failure of the job itself
+	if utils.Done(process.parentCtx) {
+		return false
+	}
+
+	return process.config.Jobs[job.Name].AllowFailure
+}
+
+func (process *ProcessPipeline) readConfig(job *ProcessJob) error {
+	var yamlContents string
+	err := process.withSidecarAttempts(job, func() error {
+		err := process.serveSidecar(job)
+		if err == nil {
+			yamlContents, err = process.sidecar.ReadFile(
+				process.ctx,
+				process.task.Pipeline.Commit,
+				process.task.Pipeline.Filename,
+			)
+			if err != nil {
+				err = karma.Format(
+					err,
+					"unable to obtain file from repository: %q",
+					process.task.Pipeline.Filename,
+				)
+			}
+		}
+
+		// next attempt starts with a fresh sidecar, so the failed one
+		// should not leak
+		if err != nil {
+			process.sidecar.Destroy()
+			process.sidecar = nil
+		}
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	process.config, err = config.Unmarshal([]byte(yamlContents))
 	if err != nil {
-		return StatusFailed, job.remoteErrorf(
+		return karma.Format(
 			err,
-			"unable to read config file",
+			"unable to unmarshal yaml data: %q",
+			process.task.Pipeline.Filename,
 		)
 	}
 
-	job.sidecar = process.sidecar
-	job.config = process.config
+	timeout := process.runnerConfig.GetTimeout(process.config.Timeout)
+	if timeout > 0 {
+		process.ctx, process.cancelTimeout = context.WithDeadline(
+			process.ctx,
+			process.startedAt.Add(timeout),
+		)
+	}
 
-	err = job.run()
-	if err != nil {
-		if utils.IsCanceled(err) {
-			// special case when runner gets terminated
-			if utils.Done(process.parentCtx) {
-				job.remoteLog("\n\nWARNING: snake-runner has been terminated")
+	return process.withSidecarAttempts(job, process.checkout)
+}
 
-				return StatusFailed, err
-			}
+// withSidecarAttempts runs the given step of repository preparation until it
+// succeeds or attempts are exhausted, it helps to survive network issues.
+// Missing files and merge conflicts are not going to disappear, so they are
+// not retried.
+func (process *ProcessPipeline) withSidecarAttempts(
+	job *ProcessJob,
+	step func() error,
+) error {
+	attempts := process.runnerConfig.SidecarAttempts
+	for attempt := 1; ; attempt++ {
+		err := step()
+		if err == nil {
+			return nil
+		}
 
-			return StatusCanceled, err
+		if attempt >= attempts ||
+			utils.Done(process.ctx) ||
+			karma.Contains(err, sidecar.ErrFileNotFound) ||
+			karma.Contains(err, sidecar.ErrMergeConflict) {
+			return err
 		}
 
-		return StatusFailed, err
+		job.remoteErrorf(
+			err,
+			"attempt %d/%d to prepare repository failed, retrying",
+			attempt, attempts,
+		)
 	}
+}
 
-	return StatusSuccess, nil
+func (process *ProcessPipeline) serveSidecar(job *ProcessJob) error {
+	process.sidecar = sidecar.NewSidecarBuilder().
+		Executor(process.executor).
+		Name(
+			fmt.Sprintf(
+				"pipeline-%d-uniq-%s",
+				process.task.Pipeline.ID,
+				utils.RandString(10),
+			),
+		).
+		Slug(
+			fmt.Sprintf(
+				"%s/%s",
+				process.task.Project.Key,
+				process.task.Repository.Slug,
+			),
+		).
+		PipelinesDir(process.runnerConfig.PipelinesDir).
+		CommandConsumer(job.sendPrompt).
+		OutputConsumer(job.remoteLog).
+		SshKey(process.sshKey).
+		Network(process.getNetworkName()).
+		Build()
+
+	err := process.sidecar.Serve(process.ctx, process.task.CloneURL.SSH)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable ot start sidecar container with repository",
+		)
+	}
+
+	return nil
 }
 
-func (process *ProcessPipeline) readConfig(job *ProcessJob) error {
-	return process.initSidecar.Do(func() error {
-		process.sidecar = sidecar.NewSidecarBuilder().
-			Cloud(process.cloud).
-			Name(
-				fmt.Sprintf(
-					"pipeline-%d-uniq-%s",
-					process.task.Pipeline.ID,
-					utils.RandString(10),
-				),
-			).
-			Slug(
-				fmt.Sprintf(
-					"%s/%s",
-					process.task.Project.Key,
-					process.task.Repository.Slug,
-				),
-			).
-			PipelinesDir(process.runnerConfig.PipelinesDir).
-			CommandConsumer(job.sendPrompt).
-			OutputConsumer(job.remoteLog).
-			SshKey(process.sshKey).
-			Build()
-
-		err := process.sidecar.Serve(
+// checkout checks out the commit of the pipeline and makes sure that the
+// repository is at the expected commit.
+func (process *ProcessPipeline) checkout() error {
+	pipeline := process.task.Pipeline
+
+	merge := process.config.Git.PullRequestMerge && pipeline.PullRequestID > 0
+
+	commitish := pipeline.Commit
+	if merge {
+		var err error
+		commitish, err = process.sidecar.Merge(
 			process.ctx,
-			process.task.CloneURL.SSH,
-			process.task.Pipeline.Commit,
+			pipeline.PullRequestID,
+			pipeline.Commit,
+			pipeline.PullRequestTargetBranch,
+			process.config.Git,
 		)
 		if err != nil {
-			return karma.Format(
-				err,
-				"unable ot start sidecar container with repository",
-			)
+			return err
+		}
+
+		// the pull request is merged already, there is no merge commit
+		if pipeline.Commit != "" && strings.HasPrefix(commitish, pipeline.Commit) {
+			merge = false
 		}
+	}
+
+	err := process.sidecar.Checkout(process.ctx, commitish, process.config.Git)
+	if err != nil {
+		return err
+	}
+
+	// the merge result contains the pipeline commit as the second parent
+	rev := "HEAD"
+	if merge {
+		rev = "HEAD^2"
+	}
+
+	commit, err := process.sidecar.Resolve(process.ctx, rev)
+	if err != nil {
+		return karma.Format(err, "unable to get checked out commit")
+	}
 
-		yamlContents, err := process.cloud.Cat(
+	if !strings.HasPrefix(commit, pipeline.Commit) {
+		return fmt.Errorf(
+			"checked out commit %s doesn't match commit of the pipeline %s",
+			commit, pipeline.Commit,
+		)
+	}
+
+	if merge {
+		process.mergeBase, err = process.sidecar.GetMergeBase(
 			process.ctx,
-			process.sidecar.GetContainer(),
-			process.sidecar.GetContainerDir(),
-			process.task.Pipeline.Filename,
+			"HEAD^1",
+			"HEAD^2",
 		)
 		if err != nil {
-			return karma.Format(
-				err,
-				"unable to obtain file from sidecar container with repository: %q",
-				process.task.Pipeline.Filename,
-			)
+			return karma.Format(err, "unable to get merge base of pull request")
 		}
+	}
 
-		process.config, err = config.Unmarshal([]byte(yamlContents))
-		if err != nil {
-			return karma.Format(
-				err,
-				"unable to unmarshal yaml data: %q",
-				process.task.Pipeline.Filename,
-			)
-		}
+	process.commit, err = process.sidecar.GetCommit(process.ctx, rev)
+	if err != nil {
+		return karma.Format(err, "unable to get metadata of commit")
+	}
 
-		return nil
-	})
+	// changed files are not critical and the base commit can be missing in
+	// a shallow clone, nil means that changed files are unknown
+	process.changedFiles, err = process.sidecar.GetChangedFiles(
+		process.ctx,
+		process.getChangesBase(),
+		process.commit.Hash,
+	)
+	if err != nil {
+		process.log.Warningf(err, "unable to get changed files")
+	}
+
+	return nil
 }
 
-func (process *ProcessPipeline) fail(failedID int) {
-	process.onceFail.Do(func() {
-		now := ptr.TimePtr(utils.Now())
+// getChangesBase returns the commit which changes of the pipeline are
+// compared with: the merge base for pull requests, the commit of the
+// previous successful pipeline or the first parent.
+func (process *ProcessPipeline) getChangesBase() string {
+	pipeline := process.task.Pipeline
 
-		var failedStage string
-		var found bool
+	if process.mergeBase != "" {
+		return process.mergeBase
+	}
 
-		for _, job := range process.task.Jobs {
-			var status string
-			var finished *time.Time
+	if pipeline.PullRequestID > 0 && pipeline.PullRequestTargetBranch != "" {
+		base, err := process.sidecar.GetMergeBase(
+			process.ctx,
+			"origin/"+pipeline.PullRequestTargetBranch,
+			process.commit.Hash,
+		)
+		if err == nil {
+			return base
+		}
 
-			switch {
-			case failedID == FailAllJobs:
-				status = StatusFailed
-				finished = now
+		process.log.Warningf(err, "unable to get merge base of pull request")
+	}
 
-			case job.ID == failedID:
-				found = true
-				failedStage = job.Stage
-				continue
+	if pipeline.PreviousSuccessfulCommit != "" {
+		return pipeline.PreviousSuccessfulCommit
+	}
 
-			case !found:
-				continue
+	if len(process.commit.Parents) > 0 {
+		return process.commit.Parents[0]
+	}
 
-			case found && job.Stage == failedStage:
-				continue
+	return ""
+}
 
-			case found:
-				status = StatusSkipped
-			}
+// fail marks all jobs as failed if FailAllJobs is given, otherwise it skips
+// all jobs which depend on the failed job.
+func (process *ProcessPipeline) fail(failedID int) {
+	if failedID != FailAllJobs {
+		for _, job := range process.getDependents(failedID, false) {
+			process.skip(job)
+		}
 
-			err := process.updateJob(
-				job.ID,
-				status,
-				nil,
-				finished,
-			)
-			if err != nil {
-				process.log.Errorf(err, "unable to update job status to %q", status)
-			}
+		return
+	}
+
+	now := ptr.TimePtr(utils.Now())
+
+	for _, job := range process.task.Jobs {
+		err := process.updateJob(
+			job.ID,
+			StatusFailed,
+			nil,
+			now,
+		)
+		if err != nil {
+			process.log.Errorf(err, "unable to update job status to %q", StatusFailed)
 		}
+	}
 
+	process.failPipeline()
+}
+
+func (process *ProcessPipeline) failPipeline() {
+	process.onceFail.Do(func() {
 		err := process.client.UpdatePipeline(
 			process.task.Pipeline.ID,
 			StatusFailed,
 			nil,
-			now,
+			ptr.TimePtr(utils.Now()),
 		)
 		if err != nil {
 			process.log.Errorf(
@@ -395,6 +828,101 @@ func (process *ProcessPipeline) fail(failedID int) {
 	})
 }
 
+func (process *ProcessPipeline) skip(job snake.PipelineJob) {
+	process.mutex.Lock()
+	if process.skipped == nil {
+		process.skipped = map[int]bool{}
+	}
+
+	if process.skipped[job.ID] {
+		process.mutex.Unlock()
+		return
+	}
+
+	process.skipped[job.ID] = true
+	process.mutex.Unlock()
+
+	err := process.updateJob(job.ID, StatusSkipped, nil, nil)
+	if err != nil {
+		process.log.Errorf(err, "unable to update job status to %q", StatusSkipped)
+	}
+}
+
+// buildEnvs builds variables of all jobs once, they are used to evaluate
+// rules of jobs and then passed to the jobs. Variables depend only on the
+// config and the checked out commit, so an error is an error of the config.
+func (process *ProcessPipeline) buildEnvs() (map[int]Env, error) {
+	envs := map[int]Env{}
+	for _, job := range process.task.Jobs {
+		env, err := NewEnvBuilder(
+			process.task,
+			process.task.Pipeline,
+			job,
+			process.config,
+			process.config.Jobs[job.Name],
+			process.runnerConfig,
+			process.getJobSidecar(job).GetContainerDir(),
+			process.mergeBase,
+			process.commit,
+			process.changedFiles,
+		).Build()
+		if err != nil {
+			return nil, karma.Format(
+				err,
+				"unable to build variables of job %q",
+				job.Name,
+			)
+		}
+
+		envs[job.ID] = env
+	}
+
+	return envs, nil
+}
+
+// getJobSidecar returns the sidecar of the pipeline or its fork if the job
+// runs in its own copy of the repository.
+func (process *ProcessPipeline) getJobSidecar(
+	job snake.PipelineJob,
+) *sidecar.Sidecar {
+	if process.config.Jobs[job.Name].Isolated {
+		return process.sidecar.Fork(getJobKey(job, 0))
+	}
+
+	return process.sidecar
+}
+
+// isIncluded evaluates rules, only and except of the job.
+func (process *ProcessPipeline) isIncluded(job snake.PipelineJob) bool {
+	pipeline := process.task.Pipeline
+
+	return process.config.Jobs[job.Name].IsIncluded(config.Context{
+		RefType:       pipeline.RefType,
+		Ref:           pipeline.RefDisplayId,
+		PullRequestID: pipeline.PullRequestID,
+		Variables:     process.envs[job.ID].mapping,
+		ChangedFiles:  process.changedFiles,
+	})
+}
+
+// exclude skips the job which doesn't match its rules and all jobs which
+// explicitly need it, jobs of next stages without 'needs' still run since the
+// excluded job is considered as satisfied.
+func (process *ProcessPipeline) exclude(job snake.PipelineJob) {
+	for _, dependent := range process.getDependents(job.ID, true) {
+		process.skip(dependent)
+	}
+
+	process.skip(job)
+}
+
+func (process *ProcessPipeline) isSkipped(job snake.PipelineJob) bool {
+	process.mutex.Lock()
+	defer process.mutex.Unlock()
+
+	return process.skipped[job.ID]
+}
+
 func (process *ProcessPipeline) updateJob(
 	id int,
 	status string,
@@ -412,8 +940,55 @@ func (process *ProcessPipeline) updateJob(
 	)
 }
 
+// createNetwork creates a network for all containers of the pipeline if the
+// runner is configured to isolate pipelines.
+func (process *ProcessPipeline) createNetwork() error {
+	if !process.runnerConfig.Docker.NetworkPerPipeline ||
+		process.executor.Type() != executor.TypeDocker {
+		return nil
+	}
+
+	var err error
+	process.network, err = process.executor.CreateNetwork(
+		process.ctx,
+		fmt.Sprintf(
+			"snake-runner-pipeline-%d-uniq-%s",
+			process.task.Pipeline.ID,
+			utils.RandString(10),
+		),
+	)
+
+	return err
+}
+
+func (process *ProcessPipeline) getNetworkName() string {
+	if process.network == nil {
+		return ""
+	}
+
+	return process.network.Name
+}
+
+// destroy destroys the sidecar and the network of the pipeline, containers of
+// jobs connected to the network are destroyed by jobs themselves before the
+// pipeline is finished.
 func (process *ProcessPipeline) destroy() {
 	if process.sidecar != nil {
 		process.sidecar.Destroy()
 	}
+
+	if process.network != nil {
+		// the pipeline context can be canceled already
+		err := process.executor.DestroyNetwork(
+			context.Background(),
+			process.network,
+		)
+		if err != nil {
+			process.log.Errorf(err, "unable to destroy network of pipeline")
+		}
+	}
+
+	if process.cancelTimeout != nil {
+		process.cancelTimeout()
+	}
 }
@@ -6,11 +6,11 @@ import (
 	"context"
 
 	"github.com/reconquest/cog"
-	"github.com/reconquest/snake-runner/internal/cloud"
+	"github.com/reconquest/snake-runner/internal/executor"
 	"github.com/reconquest/snake-runner/internal/sshkey"
 	"github.com/reconquest/snake-runner/internal/tasks"
 )
 
-func NewProcessPipeline(parentCtx context.Context, ctx context.Context, client *Client, runnerConfig *RunnerConfig, task tasks.PipelineRun, cloud *cloud.Cloud, log *cog.Logger, utilization chan *cloud.Container, sshKey sshkey.Key) *ProcessPipeline {
-	return &ProcessPipeline{parentCtx: parentCtx, ctx: ctx, client: client, runnerConfig: runnerConfig, task: task, cloud: cloud, log: log, utilization: utilization, sshKey: sshKey}
+func NewProcessPipeline(parentCtx context.Context, ctx context.Context, client *Client, runnerConfig *RunnerConfig, task tasks.PipelineRun, executor executor.Executor, log *cog.Logger, utilization chan *executor.Container, sshKey sshkey.Key) *ProcessPipeline {
+	return &ProcessPipeline{parentCtx: parentCtx, ctx: ctx, client: client, runnerConfig: runnerConfig, task: task, executor: executor, log: log, utilization: utilization, sshKey: sshKey}
 }
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/reconquest/pkg/log"
+	"github.com/reconquest/snake-runner/internal/config"
+	"github.com/reconquest/snake-runner/internal/executor"
+	"github.com/reconquest/snake-runner/internal/snake"
+	"github.com/reconquest/snake-runner/internal/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitJobs(t *testing.T) {
+	test := assert.New(t)
+
+	process := &ProcessPipeline{
+		config: config.Pipeline{
+			Stages: []string{"build", "test", "deploy"},
+		},
+		task: tasks.PipelineRun{
+			Jobs: []snake.PipelineJob{
+				{ID: 1, Name: "deploy", Stage: "deploy"},
+				{ID: 2, Name: "unit", Stage: "test"},
+				{ID: 3, Name: "build", Stage: "build"},
+				{ID: 4, Name: "integration", Stage: "test"},
+			},
+		},
+	}
+
+	stages, err := process.splitJobs()
+	test.NoError(err)
+	test.Equal(
+		[][]snake.PipelineJob{
+			{{ID: 3, Name: "build", Stage: "build"}},
+			{
+				{ID: 2, Name: "unit", Stage: "test"},
+				{ID: 4, Name: "integration", Stage: "test"},
+			},
+			{{ID: 1, Name: "deploy", Stage: "deploy"}},
+		},
+		stages,
+	)
+
+	process.config.Stages = []string{"build", "test", "deploy", "release"}
+
+	_, err = process.splitJobs()
+	test.EqualError(err, `stage "release" is declared in stages but has no jobs`)
+
+	process.config.Stages = []string{"build", "test"}
+
+	_, err = process.splitJobs()
+	test.EqualError(
+		err,
+		`job "deploy" refers to stage "deploy" which is not declared in stages`,
+	)
+}
+
+func TestGetDependents(t *testing.T) {
+	test := assert.New(t)
+
+	jobs := []snake.PipelineJob{
+		{ID: 1, Name: "build", Stage: "build"},
+		{ID: 2, Name: "lint", Stage: "build"},
+		{ID: 3, Name: "test", Stage: "test"},
+		{ID: 4, Name: "package", Stage: "test"},
+		{ID: 5, Name: "deploy", Stage: "deploy"},
+	}
+
+	process := &ProcessPipeline{
+		config: config.Pipeline{
+			Stages: []string{"build", "test", "deploy"},
+			Jobs: map[string]config.Job{
+				"build":   {Stage: "build"},
+				"lint":    {Stage: "build", Needs: []string{}},
+				"test":    {Stage: "test", Needs: []string{"build"}},
+				"package": {Stage: "test", Needs: []string{"lint"}},
+				"deploy":  {Stage: "deploy", Needs: []string{"package"}},
+			},
+		},
+		task: tasks.PipelineRun{Jobs: jobs},
+	}
+
+	stages, err := process.splitJobs()
+	test.NoError(err)
+	process.stages = stages
+
+	test.NoError(process.checkNeeds())
+
+	test.Equal(
+		[]snake.PipelineJob{jobs[2]},
+		process.getDependents(1, false),
+	)
+	test.Equal(
+		[]snake.PipelineJob{jobs[3], jobs[4]},
+		process.getDependents(2, false),
+	)
+	test.Empty(process.getDependents(5, false))
+
+	process.task.Jobs = jobs[1:]
+
+	test.EqualError(
+		process.checkNeeds(),
+		`job "test" needs job "build" which is not in the pipeline`,
+	)
+
+	process.task.Pipeline.Filename = ".snake-ci.yml"
+	process.task.Jobs = append(
+		jobs,
+		snake.PipelineJob{ID: 6, Name: "removed", Stage: "deploy"},
+	)
+
+	test.EqualError(
+		process.checkNeeds(),
+		`unable to find given job "removed" in ".snake-ci.yml"`,
+	)
+}
+
+func TestGetDependentsByExplicitNeeds(t *testing.T) {
+	test := assert.New(t)
+
+	jobs := []snake.PipelineJob{
+		{ID: 1, Name: "test", Stage: "test"},
+		{ID: 2, Name: "deploy", Stage: "deploy"},
+		{ID: 3, Name: "notify", Stage: "notify"},
+		{ID: 4, Name: "smoke", Stage: "notify"},
+		{ID: 5, Name: "report", Stage: "report"},
+	}
+
+	process := &ProcessPipeline{
+		config: config.Pipeline{
+			Stages: []string{"test", "deploy", "notify", "report"},
+			Jobs: map[string]config.Job{
+				"test":   {Stage: "test"},
+				"deploy": {Stage: "deploy"},
+				"notify": {Stage: "notify"},
+				"smoke":  {Stage: "notify", Needs: []string{"deploy"}},
+				"report": {Stage: "report", Needs: []string{"smoke"}},
+			},
+		},
+		task: tasks.PipelineRun{Jobs: jobs},
+	}
+
+	stages, err := process.splitJobs()
+	test.NoError(err)
+	process.stages = stages
+
+	test.Equal(
+		[]snake.PipelineJob{jobs[2], jobs[3], jobs[4]},
+		process.getDependents(2, false),
+	)
+	test.Equal(
+		[]snake.PipelineJob{jobs[3], jobs[4]},
+		process.getDependents(2, true),
+	)
+	test.Empty(process.getDependents(1, true))
+}
+
+func TestIsRetryable(t *testing.T) {
+	test := assert.New(t)
+
+	testcases := []struct {
+		name     string
+		retry    config.Retry
+		attempt  int
+		failure  string
+		canceled bool
+		expected bool
+	}{
+		{
+			name:     "without retry policy",
+			attempt:  1,
+			failure:  config.RetryScriptFailure,
+			expected: false,
+		},
+		{
+			name:     "attempts left",
+			retry:    config.Retry{Attempts: 3},
+			attempt:  2,
+			failure:  config.RetryScriptFailure,
+			expected: true,
+		},
+		{
+			name:     "attempts exhausted",
+			retry:    config.Retry{Attempts: 3},
+			attempt:  3,
+			failure:  config.RetryScriptFailure,
+			expected: false,
+		},
+		{
+			name: "failure is listed in when",
+			retry: config.Retry{
+				Attempts: 2,
+				When:     []string{config.RetryScriptFailure},
+			},
+			attempt:  1,
+			failure:  config.RetryScriptFailure,
+			expected: true,
+		},
+		{
+			name: "failure is not listed in when",
+			retry: config.Retry{
+				Attempts: 2,
+				When:     []string{config.RetryImagePullFailure},
+			},
+			attempt:  1,
+			failure:  config.RetryScriptFailure,
+			expected: false,
+		},
+		{
+			name: "timeout is not a script failure",
+			retry: config.Retry{
+				Attempts: 2,
+				When:     []string{config.RetryScriptFailure},
+			},
+			attempt:  1,
+			failure:  "",
+			expected: false,
+		},
+		{
+			name:     "timeout without when",
+			retry:    config.Retry{Attempts: 2},
+			attempt:  1,
+			failure:  "",
+			expected: true,
+		},
+		{
+			name: "timeout with always",
+			retry: config.Retry{
+				Attempts: 2,
+				When:     []string{config.RetryAlways},
+			},
+			attempt:  1,
+			failure:  "",
+			expected: true,
+		},
+		{
+			name:     "pipeline is canceled",
+			retry:    config.Retry{Attempts: 2},
+			attempt:  1,
+			failure:  config.RetryScriptFailure,
+			canceled: true,
+			expected: false,
+		},
+	}
+
+	for _, testcase := range testcases {
+		ctx, cancel := context.WithCancel(context.Background())
+		if testcase.canceled {
+			cancel()
+		}
+
+		process := &ProcessPipeline{
+			ctx: ctx,
+			config: config.Pipeline{
+				Jobs: map[string]config.Job{
+					"test": {Retry: testcase.retry},
+				},
+			},
+		}
+
+		test.Equal(
+			testcase.expected,
+			process.isRetryable(
+				snake.PipelineJob{ID: 1, Name: "test"},
+				testcase.attempt,
+				testcase.failure,
+			),
+			testcase.name,
+		)
+
+		cancel()
+	}
+}
+
+func TestIsFailureAllowed(t *testing.T) {
+	test := assert.New(t)
+
+	testcases := []struct {
+		name         string
+		allowFailure bool
+		status       string
+		terminated   bool
+		expected     bool
+	}{
+		{
+			name:         "non-zero exit code",
+			allowFailure: true,
+			status:       StatusFailed,
+			expected:     true,
+		},
+		{
+			name:         "timeout",
+			allowFailure: true,
+			status:       StatusTimeout,
+			expected:     true,
+		},
+		{
+			name:         "failure is not allowed",
+			allowFailure: false,
+			status:       StatusFailed,
+			expected:     false,
+		},
+		{
+			name:         "canceled",
+			allowFailure: true,
+			status:       StatusCanceled,
+			expected:     false,
+		},
+		{
+			name:         "success",
+			allowFailure: true,
+			status:       StatusSuccess,
+			expected:     false,
+		},
+		{
+			name:         "runner is terminated",
+			allowFailure: true,
+			status:       StatusFailed,
+			terminated:   true,
+			expected:     false,
+		},
+	}
+
+	for _, testcase := range testcases {
+		ctx, cancel := context.WithCancel(context.Background())
+		if testcase.terminated {
+			cancel()
+		}
+
+		process := &ProcessPipeline{
+			parentCtx: ctx,
+			config: config.Pipeline{
+				Jobs: map[string]config.Job{
+					"test": {AllowFailure: testcase.allowFailure},
+				},
+			},
+		}
+
+		test.Equal(
+			testcase.expected,
+			process.isFailureAllowed(
+				snake.PipelineJob{ID: 1, Name: "test"},
+				testcase.status,
+			),
+			testcase.name,
+		)
+
+		cancel()
+	}
+}
+
+func TestFailAndExcludeSkipDependents(t *testing.T) {
+	test := assert.New(t)
+
+	server := httptest.NewServer(
+		http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+			writer.WriteHeader(http.StatusOK)
+		}),
+	)
+	defer server.Close()
+
+	jobs := []snake.PipelineJob{
+		{ID: 1, Name: "build", Stage: "build"},
+		{ID: 2, Name: "lint", Stage: "build"},
+		{ID: 3, Name: "test", Stage: "test"},
+		{ID: 4, Name: "package", Stage: "test"},
+		{ID: 5, Name: "deploy", Stage: "deploy"},
+	}
+
+	newProcess := func() *ProcessPipeline {
+		process := &ProcessPipeline{
+			client: NewClient(&RunnerConfig{MasterAddress: server.URL}),
+			log:    log.NewChildWithPrefix("[test]"),
+			config: config.Pipeline{
+				Stages: []string{"build", "test", "deploy"},
+				Jobs: map[string]config.Job{
+					"build":   {Stage: "build"},
+					"lint":    {Stage: "build", Needs: []string{}},
+					"test":    {Stage: "test"},
+					"package": {Stage: "test", Needs: []string{"lint"}},
+					"deploy":  {Stage: "deploy", Needs: []string{"test"}},
+				},
+			},
+			task: tasks.PipelineRun{Jobs: jobs},
+		}
+
+		stages, err := process.splitJobs()
+		test.NoError(err)
+		process.stages = stages
+
+		return process
+	}
+
+	skipped := func(process *ProcessPipeline) []string {
+		names := []string{}
+		for _, job := range jobs {
+			if process.isSkipped(job) {
+				names = append(names, job.Name)
+			}
+		}
+
+		return names
+	}
+
+	// a failed job skips all jobs which need it directly or by stage
+	process := newProcess()
+	process.fail(1)
+	test.Equal([]string{"test", "deploy"}, skipped(process))
+
+	process = newProcess()
+	process.fail(2)
+	test.Equal([]string{"test", "package", "deploy"}, skipped(process))
+
+	// an excluded job skips only jobs which explicitly need it
+	process = newProcess()
+	process.exclude(jobs[2])
+	test.Equal([]string{"test", "deploy"}, skipped(process))
+}
+
+// fakeExecutor implements only methods of the executor which are used by
+// tests, other methods panic.
+type fakeExecutor struct {
+	executor.Executor
+
+	mutex sync.Mutex
+	calls []string
+}
+
+func (fake *fakeExecutor) call(call string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.calls = append(fake.calls, call)
+}
+
+func (fake *fakeExecutor) DestroyContainer(
+	ctx context.Context,
+	container *executor.Container,
+) error {
+	fake.call("destroy container " + container.Name)
+	return nil
+}
+
+func (fake *fakeExecutor) DestroyNetwork(
+	ctx context.Context,
+	network *executor.Network,
+) error {
+	fake.call("destroy network " + network.Name)
+	return nil
+}
+
+func TestPipelineNetworkIsDestroyedAfterContainers(t *testing.T) {
+	test := assert.New(t)
+
+	fake := &fakeExecutor{}
+	network := &executor.Network{ID: "net", Name: "pipeline"}
+	utilization := make(chan *executor.Container, 1)
+
+	job := &ProcessJob{
+		executor:        fake,
+		utilization:     utilization,
+		container:       &executor.Container{Name: "job"},
+		pipelineNetwork: network,
+	}
+
+	job.destroyContainer()
+
+	pipeline := &ProcessPipeline{
+		executor: fake,
+		network:  network,
+	}
+
+	pipeline.destroy()
+
+	test.Empty(utilization)
+	test.Equal(
+		[]string{"destroy container job", "destroy network pipeline"},
+		fake.calls,
+	)
+
+	job.pipelineNetwork = nil
+	job.destroyContainer()
+
+	test.Len(utilization, 1)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -10,9 +12,17 @@ import (
 
 	"gopkg.in/yaml.v2"
 
+	units "github.com/docker/go-units"
 	"github.com/kovetskiy/ko"
 	"github.com/reconquest/karma-go"
 	"github.com/reconquest/pkg/log"
+	"github.com/reconquest/snake-runner/internal/config"
+	"github.com/reconquest/snake-runner/internal/executor"
+)
+
+const (
+	VirtualizationDocker = "docker"
+	VirtualizationNone   = "none"
 )
 
 type RunnerConfig struct {
@@ -31,12 +41,110 @@ type RunnerConfig struct {
 	Virtualization       string        `yaml:"virtualization"         env:"SNAKE_VIRTUALIZATION"         default:"docker"                          required:"true"`
 	MaxParallelPipelines int64         `yaml:"max_parallel_pipelines" env:"SNAKE_MAX_PARALLEL_PIPELINES" default:"0"                               required:"true"`
 	PipelinesDir         string        `yaml:"pipelines_dir"          env:"SNAKE_PIPELINES_DIR"          default:"/var/lib/snake-runner/pipelines" required:"true"`
+	JobTimeout           time.Duration `yaml:"job_timeout"            env:"SNAKE_JOB_TIMEOUT"            default:"0"`
+	MaxTimeout           time.Duration `yaml:"max_timeout"            env:"SNAKE_MAX_TIMEOUT"            default:"0"`
+	SidecarAttempts      int           `yaml:"sidecar_attempts"       env:"SNAKE_SIDECAR_ATTEMPTS"       default:"3"`
+	CacheMaxSizeMB       int64         `yaml:"cache_max_size_mb"      env:"SNAKE_CACHE_MAX_SIZE_MB"      default:"10240"`
 	Docker               struct {
 		Network string   `yaml:"network" env:"SNAKE_DOCKER_NETWORK"`
 		Volumes []string `yaml:"volumes" env:"SNAKE_DOCKER_VOLUMES"`
+		Config  string   `yaml:"config"  env:"SNAKE_DOCKER_CONFIG"`
+
+		NetworkPerPipeline bool `yaml:"network_per_pipeline" env:"SNAKE_DOCKER_NETWORK_PER_PIPELINE"`
+
+		PullPolicy executor.PullPolicy `yaml:"pull_policy" env:"SNAKE_DOCKER_PULL_POLICY" default:"if-not-present"`
+
+		Registries map[string]executor.RegistryCredentials `yaml:"registries"`
+
+		Resources struct {
+			Default ResourcesConfig `yaml:"default"`
+			Max     ResourcesConfig `yaml:"max"`
+		} `yaml:"resources"`
+
+		Security SecurityConfig `yaml:"security"`
 	} `yaml:"docker"`
 }
 
+// SecurityConfig describes security options of job containers and which
+// options jobs are allowed to request.
+type SecurityConfig struct {
+	Privileged  bool     `yaml:"privileged"`
+	CapAdd      []string `yaml:"cap_add"`
+	CapDrop     []string `yaml:"cap_drop"`
+	SecurityOpt []string `yaml:"security_opt"`
+	ReadOnly    bool     `yaml:"read_only"`
+	Tmpfs       []string `yaml:"tmpfs"`
+	User        string   `yaml:"user"`
+
+	// Allow lists options which relax isolation and can be requested by
+	// jobs, options which only harden a container are always allowed.
+	Allow struct {
+		Privileged bool `yaml:"privileged"`
+
+		// CapAdd are capabilities which jobs can add, ALL allows any.
+		CapAdd      []string `yaml:"cap_add"`
+		SecurityOpt bool     `yaml:"security_opt"`
+		User        bool     `yaml:"user"`
+	} `yaml:"allow"`
+}
+
+func (security SecurityConfig) get() executor.Security {
+	return executor.Security{
+		Privileged:  security.Privileged,
+		CapAdd:      security.CapAdd,
+		CapDrop:     security.CapDrop,
+		SecurityOpt: security.SecurityOpt,
+		ReadOnly:    security.ReadOnly,
+		Tmpfs:       config.Security{Tmpfs: security.Tmpfs}.GetTmpfs(),
+		User:        security.User,
+	}
+}
+
+func (security SecurityConfig) isCapabilityAllowed(capability string) bool {
+	for _, allowed := range security.Allow.CapAdd {
+		allowed = normalizeCapability(allowed)
+		if allowed == "ALL" || allowed == normalizeCapability(capability) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ResourcesConfig describes limits of containers, sizes are specified in human
+// readable form like 512m or 2g, empty or zero values mean no limit.
+type ResourcesConfig struct {
+	CPUs    float64 `yaml:"cpus"`
+	Memory  string  `yaml:"memory"`
+	Pids    int64   `yaml:"pids"`
+	ShmSize string  `yaml:"shm_size"`
+}
+
+// Parse converts the config to resources of executor.
+func (config ResourcesConfig) Parse() (executor.Resources, error) {
+	resources := executor.Resources{
+		CPUs: config.CPUs,
+		Pids: config.Pids,
+	}
+
+	if config.CPUs < 0 || config.Pids < 0 {
+		return resources, errors.New("cpus and pids must be positive numbers")
+	}
+
+	var err error
+	resources.Memory, err = parseSize(config.Memory)
+	if err != nil {
+		return resources, karma.Format(err, "invalid memory")
+	}
+
+	resources.ShmSize, err = parseSize(config.ShmSize)
+	if err != nil {
+		return resources, karma.Format(err, "invalid shm_size")
+	}
+
+	return resources, nil
+}
+
 func LoadRunnerConfig(path string) (*RunnerConfig, error) {
 	log.Infof(karma.Describe("path", path), "loading configuration")
 
@@ -63,11 +171,26 @@ func LoadRunnerConfig(path string) (*RunnerConfig, error) {
 		config.AccessToken = strings.TrimSpace(string(tokenData))
 	}
 
-	if config.Virtualization == "none" {
+	if config.Virtualization == VirtualizationNone {
 		log.Warningf(nil, "No virtualization is used, all commands will be "+
 			"executed on the local host with current permissions")
 	}
 
+	err = config.Docker.PullPolicy.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = config.Docker.Resources.Default.Parse()
+	if err != nil {
+		return nil, karma.Format(err, "invalid docker.resources.default")
+	}
+
+	_, err = config.Docker.Resources.Max.Parse()
+	if err != nil {
+		return nil, karma.Format(err, "invalid docker.resources.max")
+	}
+
 	if config.MaxParallelPipelines == 0 {
 		config.MaxParallelPipelines = int64(runtime.NumCPU())
 
@@ -99,3 +222,134 @@ func LoadRunnerConfig(path string) (*RunnerConfig, error) {
 
 	return &config, nil
 }
+
+// GetTimeout limits the requested timeout with max_timeout, zero value means
+// no limit.
+func (config *RunnerConfig) GetTimeout(requested time.Duration) time.Duration {
+	if config.MaxTimeout > 0 {
+		if requested == 0 || requested > config.MaxTimeout {
+			return config.MaxTimeout
+		}
+	}
+
+	return requested
+}
+
+// GetResources fills the requested resources with default resources and
+// limits them with max resources, the config must be validated already.
+func (config *RunnerConfig) GetResources(
+	requested executor.Resources,
+) executor.Resources {
+	defaults, _ := config.Docker.Resources.Default.Parse()
+	max, _ := config.Docker.Resources.Max.Parse()
+
+	if requested.CPUs == 0 {
+		requested.CPUs = defaults.CPUs
+	}
+
+	if requested.Memory == 0 {
+		requested.Memory = defaults.Memory
+	}
+
+	if requested.Pids == 0 {
+		requested.Pids = defaults.Pids
+	}
+
+	if requested.ShmSize == 0 {
+		requested.ShmSize = defaults.ShmSize
+	}
+
+	return requested.Limit(max)
+}
+
+// GetSecurity merges security options requested by a job into options of the
+// runner, an error is returned if the job requests an option which is not
+// allowed by the runner.
+func (config *RunnerConfig) GetSecurity(
+	requested executor.Security,
+) (executor.Security, error) {
+	runner := config.Docker.Security
+	security := runner.get()
+
+	if requested.Privileged && !security.Privileged {
+		if !runner.Allow.Privileged {
+			return security, errors.New(
+				"privileged mode is not allowed by the runner",
+			)
+		}
+
+		security.Privileged = true
+	}
+
+	for _, capability := range requested.CapAdd {
+		if !runner.isCapabilityAllowed(capability) {
+			return security, fmt.Errorf(
+				"capability %s is not allowed by the runner",
+				capability,
+			)
+		}
+	}
+
+	if len(requested.SecurityOpt) > 0 && !runner.Allow.SecurityOpt {
+		return security, errors.New(
+			"security options are not allowed by the runner",
+		)
+	}
+
+	if requested.User != "" && requested.User != security.User {
+		if !runner.Allow.User {
+			return security, fmt.Errorf(
+				"user %q is not allowed by the runner",
+				requested.User,
+			)
+		}
+
+		security.User = requested.User
+	}
+
+	security.CapAdd = concatStrings(security.CapAdd, requested.CapAdd)
+	security.CapDrop = concatStrings(security.CapDrop, requested.CapDrop)
+	security.SecurityOpt = concatStrings(
+		security.SecurityOpt,
+		requested.SecurityOpt,
+	)
+
+	security.ReadOnly = security.ReadOnly || requested.ReadOnly
+
+	if len(requested.Tmpfs) > 0 {
+		tmpfs := map[string]string{}
+		for path, options := range security.Tmpfs {
+			tmpfs[path] = options
+		}
+
+		for path, options := range requested.Tmpfs {
+			tmpfs[path] = options
+		}
+
+		security.Tmpfs = tmpfs
+	}
+
+	return security, nil
+}
+
+// concatStrings returns a new slice, so slices of the runner config are never
+// modified by concurrent jobs.
+func concatStrings(a []string, b []string) []string {
+	if len(a)+len(b) == 0 {
+		return nil
+	}
+
+	return append(append([]string{}, a...), b...)
+}
+
+func normalizeCapability(capability string) string {
+	return strings.TrimPrefix(strings.ToUpper(capability), "CAP_")
+}
+
+func parseSize(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	return units.RAMInBytes(value)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/reconquest/snake-runner/internal/executor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunnerConfigGetResources(t *testing.T) {
+	test := assert.New(t)
+
+	config := RunnerConfig{}
+	config.Docker.Resources.Default = ResourcesConfig{
+		CPUs:   1,
+		Memory: "1g",
+	}
+	config.Docker.Resources.Max = ResourcesConfig{
+		CPUs:   2,
+		Memory: "4g",
+		Pids:   1024,
+	}
+
+	test.Equal(
+		executor.Resources{CPUs: 1, Memory: 1 << 30, Pids: 1024},
+		config.GetResources(executor.Resources{}),
+	)
+
+	test.Equal(
+		executor.Resources{CPUs: 2, Memory: 2 << 30, Pids: 512, ShmSize: 1 << 20},
+		config.GetResources(executor.Resources{
+			CPUs:    8,
+			Memory:  2 << 30,
+			Pids:    512,
+			ShmSize: 1 << 20,
+		}),
+	)
+}
+
+func TestRunnerConfigGetSecurity(t *testing.T) {
+	test := assert.New(t)
+
+	config := RunnerConfig{}
+	config.Docker.Security.CapDrop = []string{"NET_RAW"}
+	config.Docker.Security.Tmpfs = []string{"/tmp:rw,size=64m"}
+	config.Docker.Security.Allow.CapAdd = []string{"SYS_PTRACE"}
+
+	security, err := config.GetSecurity(executor.Security{
+		CapAdd:   []string{"cap_sys_ptrace"},
+		CapDrop:  []string{"MKNOD"},
+		ReadOnly: true,
+		Tmpfs:    map[string]string{"/run": ""},
+	})
+	test.NoError(err)
+	test.Equal(
+		executor.Security{
+			CapAdd:   []string{"cap_sys_ptrace"},
+			CapDrop:  []string{"NET_RAW", "MKNOD"},
+			ReadOnly: true,
+			Tmpfs:    map[string]string{"/tmp": "rw,size=64m", "/run": ""},
+		},
+		security,
+	)
+
+	_, err = config.GetSecurity(executor.Security{Privileged: true})
+	test.Error(err)
+
+	_, err = config.GetSecurity(executor.Security{CapAdd: []string{"SYS_ADMIN"}})
+	test.Error(err)
+
+	config.Docker.Security.Allow.Privileged = true
+
+	security, err = config.GetSecurity(executor.Security{Privileged: true})
+	test.NoError(err)
+	test.True(security.Privileged)
+}
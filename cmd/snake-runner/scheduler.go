@@ -9,7 +9,7 @@ import (
 
 	"github.com/reconquest/karma-go"
 	"github.com/reconquest/pkg/log"
-	"github.com/reconquest/snake-runner/internal/cloud"
+	"github.com/reconquest/snake-runner/internal/executor"
 	"github.com/reconquest/snake-runner/internal/safemap"
 	"github.com/reconquest/snake-runner/internal/sshkey"
 	"github.com/reconquest/snake-runner/internal/tasks"
@@ -17,12 +17,12 @@ import (
 
 type Scheduler struct {
 	client         *Client
-	cloud          *cloud.Cloud
+	executor       executor.Executor
 	pipelinesMap   safemap.IntToAny
 	pipelines      int64
 	pipelinesGroup sync.WaitGroup
 	cancels        safemap.IntToContextCancelFunc
-	utilization    chan *cloud.Container
+	utilization    chan *executor.Container
 	config         *RunnerConfig
 
 	sshKeyFactory *sshkey.Factory
@@ -34,10 +34,7 @@ type Scheduler struct {
 }
 
 func (runner *Runner) startScheduler() error {
-	docker, err := cloud.NewDocker(
-		runner.config.Docker.Network,
-		runner.config.Docker.Volumes,
-	)
+	provider, err := NewExecutor(runner.config)
 	if err != nil {
 		return karma.Format(err, "unable to initialize container provider")
 	}
@@ -46,8 +43,8 @@ func (runner *Runner) startScheduler() error {
 
 	scheduler := &Scheduler{
 		client:      runner.client,
-		cloud:       docker,
-		utilization: make(chan *cloud.Container, runner.config.MaxParallelPipelines*2),
+		executor:    provider,
+		utilization: make(chan *executor.Container, runner.config.MaxParallelPipelines*2),
 		config:      runner.config,
 		sshKeyFactory: sshkey.NewFactory(
 			ctx,
@@ -60,7 +57,7 @@ func (runner *Runner) startScheduler() error {
 		cancel:       cancel,
 	}
 
-	err = docker.Cleanup(context.Background())
+	err = provider.Cleanup(context.Background())
 	if err != nil {
 		return karma.Format(err, "unable to cleanup old containers")
 	}
@@ -161,7 +158,7 @@ func (scheduler *Scheduler) getAndServe() (bool, error) {
 
 func (scheduler *Scheduler) utilize() {
 	for container := range scheduler.utilization {
-		err := scheduler.cloud.DestroyContainer(context.Background(), container)
+		err := scheduler.executor.DestroyContainer(context.Background(), container)
 		if err != nil {
 			log.Errorf(
 				karma.Describe("id", container.ID).
@@ -240,7 +237,7 @@ func (scheduler *Scheduler) startPipeline(
 		scheduler.client,
 		scheduler.config,
 		task,
-		scheduler.cloud,
+		scheduler.executor,
 		log.NewChildWithPrefix(fmt.Sprintf("[pipeline:%d]", task.Pipeline.ID)),
 		scheduler.utilization,
 		sshKey,
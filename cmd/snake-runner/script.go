@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/reconquest/snake-runner/internal/executor"
+	"github.com/reconquest/snake-runner/internal/utils"
+)
+
+// Script runs all commands of a job in a single shell session, so changes of
+// working directory or exported variables are visible to next commands.
+//
+// Before every command the script prints a marker line with index of the
+// command, the marker is never shown to user, instead it gets replaced with
+// a prompt of the command. The index is used to find out which command has
+// failed.
+//
+//go:generate gonstructor -type Script -init init
+type Script struct {
+	commands []string
+	prompt   executor.CommandConsumer
+	output   executor.OutputConsumer
+
+	marker  string `gonstructor:"-"`
+	current int    `gonstructor:"-"`
+	pending string `gonstructor:"-"`
+}
+
+func (script *Script) init() {
+	script.marker = "__snake_" + utils.RandString(16)
+	script.current = -1
+}
+
+// String returns the script contents, commands are executed one by one and
+// the script exits as soon as any of the commands fails.
+//
+// Tracing (set -x) enabled by the user is turned off while the script prints
+// markers and checks exit codes, so only commands of the user are traced.
+func (script *Script) String() string {
+	// the marker is printed as two parts in order to not have it in the
+	// output even if the shell echoes the script (set -v)
+	prefix, suffix := script.marker[:len(script.marker)/2],
+		script.marker[len(script.marker)/2:]
+
+	lines := []string{
+		`{ __snake_flags=$-; set +x; } 2>/dev/null`,
+	}
+	for index, command := range script.commands {
+		lines = append(
+			lines,
+			fmt.Sprintf("printf '%%s%%s %%d\\n' '%s' '%s' %d", prefix, suffix, index),
+			`case "$__snake_flags" in *x*) set -x;; esac`,
+			command,
+			`{ __snake_status=$?; __snake_flags=$-; set +x; } 2>/dev/null`,
+			`[ "$__snake_status" -eq 0 ] || exit "$__snake_status"`,
+		)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Write consumes output of the script, it can be passed to executor as an
+// output consumer.
+func (script *Script) Write(text string) {
+	data := script.pending + text
+	script.pending = ""
+
+	for {
+		begin := strings.Index(data, script.marker)
+		if begin == -1 {
+			break
+		}
+
+		end := strings.IndexByte(data[begin:], '\n')
+		if end == -1 {
+			// the marker line is not finished yet
+			script.write(data[:begin])
+			script.pending = data[begin:]
+			return
+		}
+
+		script.write(data[:begin])
+		script.switchCommand(data[begin+len(script.marker) : begin+end])
+
+		data = data[begin+end+1:]
+	}
+
+	// the data can end with a beginning of next marker
+	keep := 0
+	for size := len(script.marker) - 1; size > 0; size-- {
+		if strings.HasSuffix(data, script.marker[:size]) {
+			keep = size
+			break
+		}
+	}
+
+	script.write(data[:len(data)-keep])
+	script.pending = data[len(data)-keep:]
+}
+
+// Flush passes the rest of the buffered output to the consumer.
+func (script *Script) Flush() {
+	script.write(script.pending)
+	script.pending = ""
+}
+
+// GetCurrentCommand returns the command which has been started last.
+func (script *Script) GetCurrentCommand() (string, bool) {
+	if script.current < 0 {
+		return "", false
+	}
+
+	return script.commands[script.current], true
+}
+
+func (script *Script) switchCommand(value string) {
+	index, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || index < 0 || index >= len(script.commands) {
+		return
+	}
+
+	script.current = index
+	script.prompt([]string{script.commands[index]})
+}
+
+func (script *Script) write(text string) {
+	if text != "" {
+		script.output(text)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func runScript(commands []string, chunkSize int) (string, string, bool, error) {
+	return runScriptWithShell("sh", commands, chunkSize)
+}
+
+func runScriptWithShell(
+	shell string,
+	commands []string,
+	chunkSize int,
+) (string, string, bool, error) {
+	output := ""
+	script := NewScript(
+		commands,
+		func(cmd []string) {
+			output += "\n$ " + strings.Join(cmd, " ") + "\n"
+		},
+		func(text string) {
+			output += text
+		},
+	)
+
+	data, err := exec.Command(shell, "-c", script.String()).CombinedOutput()
+
+	for len(data) > 0 {
+		size := chunkSize
+		if size > len(data) {
+			size = len(data)
+		}
+
+		script.Write(string(data[:size]))
+		data = data[size:]
+	}
+
+	script.Flush()
+
+	command, ok := script.GetCurrentCommand()
+
+	return output, command, ok, err
+}
+
+func TestScriptKeepsSession(t *testing.T) {
+	test := assert.New(t)
+
+	for _, chunkSize := range []int{1, 3, 1024} {
+		output, command, ok, err := runScript(
+			[]string{
+				"cd /",
+				"export FOO=bar",
+				"echo $FOO; pwd",
+			},
+			chunkSize,
+		)
+
+		test.NoError(err)
+		test.True(ok)
+		test.Equal("echo $FOO; pwd", command)
+		test.Equal(
+			"\n$ cd /\n"+
+				"\n$ export FOO=bar\n"+
+				"\n$ echo $FOO; pwd\nbar\n/\n",
+			output,
+		)
+	}
+}
+
+func TestScriptStopsOnFailure(t *testing.T) {
+	test := assert.New(t)
+
+	for _, chunkSize := range []int{1, 1024} {
+		output, command, ok, err := runScript(
+			[]string{
+				"printf no-newline",
+				"false",
+				"echo unreachable",
+			},
+			chunkSize,
+		)
+
+		test.Error(err)
+		test.True(ok)
+		test.Equal("false", command)
+		test.Equal(
+			"\n$ printf no-newline\nno-newline"+
+				"\n$ false\n",
+			output,
+		)
+	}
+}
+
+func TestScriptWithTracing(t *testing.T) {
+	test := assert.New(t)
+
+	output, _, _, err := runScript([]string{"set -x", "true"}, 1024)
+
+	test.NoError(err)
+	test.Equal(1, strings.Count(output, "\n$ true\n"))
+}
+
+func TestScriptHidesItselfFromTracing(t *testing.T) {
+	test := assert.New(t)
+
+	for _, shell := range []string{"sh", "bash"} {
+		if _, err := exec.LookPath(shell); err != nil {
+			continue
+		}
+
+		output, command, ok, err := runScriptWithShell(
+			shell,
+			[]string{
+				"set -x",
+				"echo traced",
+				"set +x",
+				"echo untraced",
+				"false",
+			},
+			1024,
+		)
+
+		test.Error(err, shell)
+		test.True(ok, shell)
+		test.Equal("false", command, shell)
+		test.Equal(
+			"\n$ set -x\n"+
+				"\n$ echo traced\n+ echo traced\ntraced\n"+
+				"\n$ set +x\n+ set +x\n"+
+				"\n$ echo untraced\nuntraced\n"+
+				"\n$ false\n",
+			output,
+			shell,
+		)
+	}
+}
@@ -9,6 +9,7 @@ const (
 	StatusFailed   = "FAILED"
 	StatusCanceled = "CANCELED"
 	StatusSkipped  = "SKIPPED"
+	StatusTimeout  = "TIMEOUT"
 
 	StatusUnknown = "UNKNOWN"
 )
@@ -18,5 +19,6 @@ func isFinalStatus(status string) bool {
 	return status == StatusSuccess ||
 		status == StatusFailed ||
 		status == StatusCanceled ||
-		status == StatusSkipped
+		status == StatusSkipped ||
+		status == StatusTimeout
 }
@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListScript prints modification time, size and path of every cache archive
+// in the given directory, a missing directory has no archives. Temporary
+// files of archives which are being written right now are not finished yet,
+// so they are not listed. It's executed as: sh -c script sh <dir>
+const ListScript = `
+set -e
+[ -d "$1" ] || exit 0
+find "$1" -type f -name '*.tar.gz' -exec stat -c '%Y %s %n' {} \;
+`
+
+// Entry is a cache archive, usage of the archive is tracked by its
+// modification time.
+type Entry struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ParseList parses output of ListScript.
+func ParseList(output string) ([]Entry, error) {
+	entries := []Entry{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected line in list of caches: %q", line)
+		}
+
+		modTime, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modification time of cache: %q", line)
+		}
+
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size of cache: %q", line)
+		}
+
+		entries = append(entries, Entry{
+			Path:    fields[2],
+			Size:    size,
+			ModTime: time.Unix(modTime, 0),
+		})
+	}
+
+	return entries, nil
+}
+
+// Evict returns paths of least recently used archives which should be
+// removed, so the total size of the rest fits the limit.
+func Evict(entries []Entry, limit int64) []string {
+	total := int64(0)
+	for _, entry := range entries {
+		total += entry.Size
+	}
+
+	sorted := append([]Entry{}, entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].ModTime.Before(sorted[j].ModTime)
+	})
+
+	removed := []string{}
+	for _, entry := range sorted {
+		if total <= limit {
+			break
+		}
+
+		total -= entry.Size
+		removed = append(removed, entry.Path)
+	}
+
+	return removed
+}
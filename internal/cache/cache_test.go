@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListAndEvict(t *testing.T) {
+	test := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "snake-cache-")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	files := []struct {
+		name string
+		age  time.Duration
+	}{
+		{"a/old.tar.gz", time.Hour * 3},
+		{"b/middle.tar.gz", time.Hour * 2},
+		{"a/new.tar.gz", time.Hour},
+		{"a/new.tar.gz.abcdef", time.Hour * 4},
+	}
+
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			panic(err)
+		}
+
+		err = ioutil.WriteFile(path, make([]byte, 100), 0644)
+		if err != nil {
+			panic(err)
+		}
+
+		err = os.Chtimes(path, now.Add(-file.age), now.Add(-file.age))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	output, err := exec.Command("sh", "-c", ListScript, "sh", dir).Output()
+	test.NoError(err)
+
+	entries, err := ParseList(string(output))
+	test.NoError(err)
+	test.Len(entries, 3)
+
+	test.Equal(
+		[]string{
+			filepath.Join(dir, "a/old.tar.gz"),
+			filepath.Join(dir, "b/middle.tar.gz"),
+		},
+		Evict(entries, 150),
+	)
+	test.Empty(Evict(entries, 300))
+
+	output, err = exec.Command(
+		"sh", "-c", ListScript, "sh", filepath.Join(dir, "missing"),
+	).Output()
+	test.NoError(err)
+	test.Empty(string(output))
+}
+
+func TestParseList(t *testing.T) {
+	test := assert.New(t)
+
+	entries, err := ParseList("1600000000 100 /cache/with space.tar.gz\n")
+	test.NoError(err)
+	test.Equal(
+		[]Entry{{
+			Path:    "/cache/with space.tar.gz",
+			Size:    100,
+			ModTime: time.Unix(1600000000, 0),
+		}},
+		entries,
+	)
+
+	_, err = ParseList("garbage\n")
+	test.Error(err)
+}
@@ -2,8 +2,15 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
+	units "github.com/docker/go-units"
 	"github.com/reconquest/karma-go"
+	"github.com/reconquest/snake-runner/internal/executor"
 	"gopkg.in/yaml.v3"
 )
 
@@ -12,15 +19,291 @@ type Pipeline struct {
 	Shell     string            `json:"shell"     yaml:"shell"`
 	Image     string            `json:"image"     yaml:"image"`
 	Stages    []string          `json:"stages"    yaml:"stages"`
+	Timeout   time.Duration     `json:"timeout"   yaml:"timeout"`
+	Services  []Service         `json:"services"  yaml:"services"`
+	Git       Git               `json:"git"       yaml:"git"`
 	Jobs      map[string]Job    `json:"jobs"      yaml:"jobs"`
+
+	// Files are names of variables which values are written to files, the
+	// variables contain paths of the files.
+	Files []string `json:"files" yaml:"files"`
+}
+
+const (
+	SubmodulesNone      = "none"
+	SubmodulesNormal    = "normal"
+	SubmodulesRecursive = "recursive"
+)
+
+// Git describes how the repository is checked out.
+type Git struct {
+	// Depth limits history of the clone, zero means full history.
+	Depth      int    `json:"depth"      yaml:"depth"`
+	Submodules string `json:"submodules" yaml:"submodules"`
+	LFS        bool   `json:"lfs"        yaml:"lfs"`
+
+	// Sparse are sparse-checkout patterns, only matching files are checked
+	// out.
+	Sparse []string `json:"sparse" yaml:"sparse"`
+
+	// PullRequestMerge enables checkout of the result of merging a pull
+	// request into its target branch instead of the pull request itself.
+	PullRequestMerge bool `json:"pull_request_merge" yaml:"pull_request_merge"`
 }
 
 type Job struct {
 	Variables map[string]string `json:"variables" yaml:"variables"`
+	Files     []string          `json:"files"     yaml:"files"`
 	Stage     string            `yaml:"stage"     yaml:"stage"`
 	Shell     string            `yaml:"shell"     yaml:"shell"`
 	Image     string            `yaml:"image"     yaml:"image"`
 	Commands  []string          `yaml:"commands"  yaml:"commands"`
+	Timeout   time.Duration     `json:"timeout"   yaml:"timeout"`
+
+	AllowFailure bool     `json:"allow_failure" yaml:"allow_failure"`
+	Retry        Retry    `json:"retry"         yaml:"retry"`
+	Needs        []string `json:"needs"         yaml:"needs"`
+	Parallel     Parallel `json:"parallel"      yaml:"parallel"`
+
+	Services  []Service `json:"services"  yaml:"services"`
+	Artifacts Artifacts `json:"artifacts" yaml:"artifacts"`
+	Cache     Cache     `json:"cache"     yaml:"cache"`
+
+	// Isolated runs the job in its own copy of the repository directory
+	// instead of the directory shared by all jobs of the pipeline, so jobs
+	// running at the same time don't overwrite files of each other. Files
+	// created by previous jobs get to the copy only as artifacts. Variants
+	// of a matrix job are always isolated.
+	Isolated bool `json:"isolated" yaml:"isolated"`
+
+	PullPolicy executor.PullPolicy `json:"pull_policy" yaml:"pull_policy"`
+	Resources  Resources           `json:"resources"   yaml:"resources"`
+	Security   Security            `json:"security"    yaml:"security"`
+
+	// Only and Except filter pipelines the job runs in, Rules are a more
+	// flexible alternative to them.
+	Only   Filter `json:"only"   yaml:"only"`
+	Except Filter `json:"except" yaml:"except"`
+	Rules  []Rule `json:"rules"  yaml:"rules"`
+}
+
+// Security are security options requested by a job, options which relax
+// isolation of the container are applied only if the runner allows them.
+type Security struct {
+	Privileged  bool     `json:"privileged"   yaml:"privileged"`
+	CapAdd      []string `json:"cap_add"      yaml:"cap_add"`
+	CapDrop     []string `json:"cap_drop"     yaml:"cap_drop"`
+	SecurityOpt []string `json:"security_opt" yaml:"security_opt"`
+	ReadOnly    bool     `json:"read_only"    yaml:"read_only"`
+	User        string   `json:"user"         yaml:"user"`
+
+	// Tmpfs are mounts in format path[:options] like /tmp:rw,size=64m.
+	Tmpfs []string `json:"tmpfs" yaml:"tmpfs"`
+}
+
+// GetTmpfs returns options of tmpfs mounts by path.
+func (security Security) GetTmpfs() map[string]string {
+	if len(security.Tmpfs) == 0 {
+		return nil
+	}
+
+	tmpfs := map[string]string{}
+	for _, mount := range security.Tmpfs {
+		path, options := mount, ""
+		if index := strings.Index(mount, ":"); index != -1 {
+			path, options = mount[:index], mount[index+1:]
+		}
+
+		tmpfs[path] = options
+	}
+
+	return tmpfs
+}
+
+// Resources are limits requested by a job, the runner clamps them to its own
+// limits.
+type Resources struct {
+	CPUs    float64  `json:"cpus"     yaml:"cpus"`
+	Memory  ByteSize `json:"memory"   yaml:"memory"`
+	Pids    int64    `json:"pids"     yaml:"pids"`
+	ShmSize ByteSize `json:"shm_size" yaml:"shm_size"`
+}
+
+// ByteSize is a number of bytes which is specified in human readable form
+// like 512m or 2g.
+type ByteSize int64
+
+// UnmarshalYAML parses sizes with units, a plain number is a number of bytes.
+func (size *ByteSize) UnmarshalYAML(node *yaml.Node) error {
+	value, err := units.RAMInBytes(node.Value)
+	if err != nil {
+		return fmt.Errorf("invalid size: %q", node.Value)
+	}
+
+	*size = ByteSize(value)
+
+	return nil
+}
+
+// Cache is a set of directories which are kept between pipelines, for
+// example downloaded dependencies.
+type Cache struct {
+	// Key identifies the cache, variables are expanded in the key.
+	Key string `json:"key" yaml:"key"`
+
+	// Files are paths of files which checksum becomes a part of the key, so
+	// the cache is invalidated when any of the files changes.
+	Files []string `json:"files" yaml:"files"`
+
+	// Paths are glob patterns relative to the repository directory.
+	Paths []string `json:"paths" yaml:"paths"`
+}
+
+// Artifacts are files produced by a job which are passed to the jobs that
+// need it.
+type Artifacts struct {
+	// Paths are glob patterns relative to the repository directory.
+	Paths []string `json:"paths" yaml:"paths"`
+}
+
+// Service is an auxiliary container (a database, a cache) which is started
+// before the job and is reachable from the job by its alias.
+type Service struct {
+	Image     string            `json:"image"     yaml:"image"`
+	Alias     string            `json:"alias"     yaml:"alias"`
+	Variables map[string]string `json:"variables" yaml:"variables"`
+}
+
+// UnmarshalYAML accepts both a full service definition and just an image.
+func (service *Service) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*service = Service{Image: node.Value}
+		return nil
+	}
+
+	type plain Service
+
+	return node.Decode((*plain)(service))
+}
+
+// GetAlias returns the alias of the service, if it's not specified then the
+// image name without registry, path and tag is used: postgres for
+// registry.example.com/library/postgres:13.
+func (service Service) GetAlias() string {
+	if service.Alias != "" {
+		return service.Alias
+	}
+
+	name := service.Image
+	if index := strings.LastIndex(name, "@"); index != -1 {
+		name = name[:index]
+	}
+
+	if index := strings.LastIndex(name, "/"); index != -1 {
+		name = name[index+1:]
+	}
+
+	if index := strings.LastIndex(name, ":"); index != -1 {
+		name = name[:index]
+	}
+
+	return name
+}
+
+// Parallel describes how a single job definition is expanded into several
+// variants which are run at the same time.
+type Parallel struct {
+	// Matrix is a list of variable sets, every set produces all combinations
+	// of values of its variables.
+	Matrix []map[string]MatrixValues `json:"matrix" yaml:"matrix"`
+}
+
+// MatrixValues is a list of values of a matrix variable, a single scalar
+// value is accepted as well.
+type MatrixValues []string
+
+func (values *MatrixValues) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*values = MatrixValues{node.Value}
+		return nil
+	}
+
+	var list []string
+	err := node.Decode(&list)
+	if err != nil {
+		return err
+	}
+
+	*values = MatrixValues(list)
+
+	return nil
+}
+
+// GetVariants returns variables of every variant of the job produced by
+// the matrix, nil is returned if the job has no matrix.
+func (job Job) GetVariants() []map[string]string {
+	var variants []map[string]string
+
+	for _, set := range job.Parallel.Matrix {
+		keys := []string{}
+		for key := range set {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		combinations := []map[string]string{{}}
+		for _, key := range keys {
+			next := []map[string]string{}
+			for _, combination := range combinations {
+				for _, value := range set[key] {
+					variant := map[string]string{}
+					for k, v := range combination {
+						variant[k] = v
+					}
+
+					variant[key] = value
+
+					next = append(next, variant)
+				}
+			}
+
+			combinations = next
+		}
+
+		variants = append(variants, combinations...)
+	}
+
+	return variants
+}
+
+const (
+	RetryAlways              = "always"
+	RetryImagePullFailure    = "image_pull_failure"
+	RetryScriptFailure       = "script_failure"
+	RetryRunnerSystemFailure = "runner_system_failure"
+)
+
+type Retry struct {
+	// Attempts is a max number of job runs including the first one.
+	Attempts int      `json:"attempts" yaml:"attempts"`
+	When     []string `json:"when"     yaml:"when"`
+}
+
+// Allows returns true if a failure with given reason should be retried,
+// nothing listed in 'when' means any failure.
+func (retry Retry) Allows(failure string) bool {
+	if len(retry.When) == 0 {
+		return true
+	}
+
+	for _, when := range retry.When {
+		if when == RetryAlways || when == failure {
+			return true
+		}
+	}
+
+	return false
 }
 
 func Unmarshal(data []byte) (Pipeline, error) {
@@ -58,6 +341,72 @@ func Unmarshal(data []byte) (Pipeline, error) {
 		delete(raw, "stages")
 	}
 
+	if node, ok := raw["variables"]; ok {
+		err = node.Decode(&config.Variables)
+		if err != nil {
+			return config, karma.Format(
+				err,
+				"invalid yaml field: 'variables'",
+			)
+		}
+
+		delete(raw, "variables")
+	}
+
+	if node, ok := raw["files"]; ok {
+		err = node.Decode(&config.Files)
+		if err == nil {
+			err = validateFiles(config.Files)
+		}
+		if err != nil {
+			return config, karma.Format(
+				err,
+				"invalid yaml field: 'files'",
+			)
+		}
+
+		delete(raw, "files")
+	}
+
+	if node, ok := raw["services"]; ok {
+		err = node.Decode(&config.Services)
+		if err != nil {
+			return config, karma.Format(
+				err,
+				"invalid yaml field: 'services'",
+			)
+		}
+
+		delete(raw, "services")
+	}
+
+	if node, ok := raw["git"]; ok {
+		err = node.Decode(&config.Git)
+		if err == nil {
+			err = validateGit(config.Git)
+		}
+		if err != nil {
+			return config, karma.Format(
+				err,
+				"invalid yaml field: 'git'",
+			)
+		}
+
+		delete(raw, "git")
+	}
+
+	if node, ok := raw["timeout"]; ok {
+		err = node.Decode(&config.Timeout)
+		if err != nil {
+			return config, karma.Format(
+				err,
+				"invalid yaml field: 'timeout'",
+			)
+		}
+
+		delete(raw, "timeout")
+	}
+
 	config.Jobs = map[string]Job{}
 	for jobName, node := range raw {
 		var job Job
@@ -69,18 +418,348 @@ func Unmarshal(data []byte) (Pipeline, error) {
 			)
 		}
 
+		err = validateRetry(job.Retry)
+		if err != nil {
+			return config, karma.Format(
+				err,
+				"invalid yaml job: '%s'", jobName,
+			)
+		}
+
+		err = validateParallel(job.Parallel)
+		if err != nil {
+			return config, karma.Format(
+				err,
+				"invalid yaml job: '%s'", jobName,
+			)
+		}
+
+		err = validatePaths("artifacts path", job.Artifacts.Paths)
+		if err == nil {
+			err = job.PullPolicy.Validate()
+		}
+		if err == nil {
+			err = validatePaths("cache path", job.Cache.Paths)
+		}
+		if err == nil {
+			err = validatePaths("cache file", job.Cache.Files)
+		}
+		if err == nil {
+			err = validateResources(job.Resources)
+		}
+		if err == nil {
+			err = validateSecurity(job.Security)
+		}
+		if err == nil {
+			err = validateFiles(job.Files)
+		}
+		if err == nil {
+			err = validateRules(job)
+		}
+		if err != nil {
+			return config, karma.Format(
+				err,
+				"invalid yaml job: '%s'", jobName,
+			)
+		}
+
 		config.Jobs[jobName] = job
 	}
 
-	if node, ok := raw["variables"]; ok {
-		err = node.Decode(&config.Variables)
+	for jobName, job := range config.Jobs {
+		if !hasStage(config.Stages, job.Stage) {
+			return config, fmt.Errorf(
+				"invalid yaml job: '%s', stage '%s' is not declared in stages",
+				jobName, job.Stage,
+			)
+		}
+	}
+
+	err = validateNeeds(config)
+	if err != nil {
+		return config, err
+	}
+
+	for _, jobName := range config.GetJobNames() {
+		err = validateServices(config.GetServices(jobName))
 		if err != nil {
 			return config, karma.Format(
 				err,
-				"invalid yaml field: 'variables'",
+				"invalid yaml job: '%s'", jobName,
 			)
 		}
 	}
 
 	return config, nil
 }
+
+// GetJobNames returns names of all jobs in alphabetical order.
+func (pipeline Pipeline) GetJobNames() []string {
+	names := []string{}
+	for name := range pipeline.Jobs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// GetNeeds returns names of jobs which should be finished before the given
+// job starts: jobs listed in 'needs' or all jobs of previous stages if
+// 'needs' is not specified.
+func (pipeline Pipeline) GetNeeds(jobName string) []string {
+	job, ok := pipeline.Jobs[jobName]
+	if !ok {
+		return nil
+	}
+
+	if job.Needs != nil {
+		return job.Needs
+	}
+
+	needs := []string{}
+	for _, stage := range pipeline.Stages {
+		if stage == job.Stage {
+			break
+		}
+
+		for _, name := range pipeline.GetJobNames() {
+			if name != jobName && pipeline.Jobs[name].Stage == stage {
+				needs = append(needs, name)
+			}
+		}
+	}
+
+	return needs
+}
+
+// GetServices returns services of the job, services of the pipeline are
+// used if the job doesn't specify its own.
+func (pipeline Pipeline) GetServices(jobName string) []Service {
+	job := pipeline.Jobs[jobName]
+	if job.Services != nil {
+		return job.Services
+	}
+
+	return pipeline.Services
+}
+
+func hasStage(stages []string, stage string) bool {
+	for _, declared := range stages {
+		if declared == stage {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validateNeeds(pipeline Pipeline) error {
+	for _, name := range pipeline.GetJobNames() {
+		for _, need := range pipeline.Jobs[name].Needs {
+			if _, ok := pipeline.Jobs[need]; !ok {
+				return fmt.Errorf(
+					"invalid yaml job: '%s', needs unknown job '%s'",
+					name, need,
+				)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	states := map[string]int{}
+	path := []string{}
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch states[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf(
+				"jobs have cyclic dependencies: %s",
+				strings.Join(append(path, name), " → "),
+			)
+		}
+
+		states[name] = visiting
+		path = append(path, name)
+
+		for _, need := range pipeline.GetNeeds(name) {
+			err := visit(need)
+			if err != nil {
+				return err
+			}
+		}
+
+		path = path[:len(path)-1]
+		states[name] = visited
+
+		return nil
+	}
+
+	for _, name := range pipeline.GetJobNames() {
+		err := visit(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateRetry(retry Retry) error {
+	if retry.Attempts < 0 {
+		return fmt.Errorf(
+			"invalid retry attempts: %d, must be a positive number",
+			retry.Attempts,
+		)
+	}
+
+	for _, when := range retry.When {
+		switch when {
+		case RetryAlways,
+			RetryImagePullFailure,
+			RetryScriptFailure,
+			RetryRunnerSystemFailure:
+		default:
+			return fmt.Errorf(
+				"invalid retry condition: %q, expected one of: %s",
+				when,
+				strings.Join([]string{
+					RetryAlways,
+					RetryImagePullFailure,
+					RetryScriptFailure,
+					RetryRunnerSystemFailure,
+				}, ", "),
+			)
+		}
+	}
+
+	return nil
+}
+
+func validateParallel(parallel Parallel) error {
+	for _, set := range parallel.Matrix {
+		if len(set) == 0 {
+			return errors.New("invalid parallel matrix: empty variables set")
+		}
+
+		for key, values := range set {
+			if len(values) == 0 {
+				return fmt.Errorf(
+					"invalid parallel matrix: variable %q has no values",
+					key,
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateServices(services []Service) error {
+	aliases := map[string]bool{}
+	for _, service := range services {
+		if service.Image == "" {
+			return errors.New("invalid service: image is not specified")
+		}
+
+		alias := service.GetAlias()
+		if aliases[alias] {
+			return fmt.Errorf("invalid service: duplicate alias %q", alias)
+		}
+
+		aliases[alias] = true
+	}
+
+	return nil
+}
+
+func validatePaths(kind string, paths []string) error {
+	for _, path := range paths {
+		clean := filepath.Clean(path)
+		if path == "" || filepath.IsAbs(path) ||
+			clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf(
+				"invalid %s: %q, must be relative to the repository directory",
+				kind,
+				path,
+			)
+		}
+	}
+
+	return nil
+}
+
+func validateResources(resources Resources) error {
+	if resources.CPUs < 0 {
+		return fmt.Errorf(
+			"invalid resources cpus: %v, must be a positive number",
+			resources.CPUs,
+		)
+	}
+
+	if resources.Memory < 0 || resources.ShmSize < 0 || resources.Pids < 0 {
+		return errors.New(
+			"invalid resources: memory, shm_size and pids must be positive",
+		)
+	}
+
+	return nil
+}
+
+func validateSecurity(security Security) error {
+	for path := range security.GetTmpfs() {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf(
+				"invalid tmpfs: %q, path must be absolute",
+				path,
+			)
+		}
+	}
+
+	return nil
+}
+
+func validateFiles(files []string) error {
+	for _, name := range files {
+		if name == "" || name == "." || name == ".." ||
+			strings.ContainsAny(name, "/=") {
+			return fmt.Errorf("invalid file variable name: %q", name)
+		}
+	}
+
+	return nil
+}
+
+func validateGit(git Git) error {
+	if git.Depth < 0 {
+		return fmt.Errorf(
+			"invalid depth: %d, must be a positive number",
+			git.Depth,
+		)
+	}
+
+	switch git.Submodules {
+	case "", SubmodulesNone, SubmodulesNormal, SubmodulesRecursive:
+	default:
+		return fmt.Errorf(
+			"invalid submodules: %q, expected one of: %s",
+			git.Submodules,
+			strings.Join([]string{
+				SubmodulesNone,
+				SubmodulesNormal,
+				SubmodulesRecursive,
+			}, ", "),
+		)
+	}
+
+	return nil
+}
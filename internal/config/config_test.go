@@ -11,6 +11,8 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+var dumper = spew.ConfigState{Indent: " ", SortKeys: true}
+
 func TestUnmarshal(t *testing.T) {
 	test := assert.New(t)
 
@@ -39,7 +41,7 @@ func TestUnmarshal(t *testing.T) {
 
 			expectedErr := string(contents)
 
-			test.Equal(expectedErr, pipelineErr)
+			test.EqualError(pipelineErr, strings.TrimSpace(expectedErr), name)
 			tested = true
 		} else {
 			test.NoError(pipelineErr)
@@ -56,7 +58,7 @@ func TestUnmarshal(t *testing.T) {
 			//    panic(err)
 			//}
 
-			encoded := spew.Sdump(pipeline)
+			encoded := dumper.Sdump(pipeline)
 
 			test.EqualValues(string(contents), string(encoded))
 			tested = true
@@ -69,3 +71,164 @@ func TestUnmarshal(t *testing.T) {
 
 	_ = test
 }
+
+func TestGetVariants(t *testing.T) {
+	test := assert.New(t)
+
+	job := Job{
+		Parallel: Parallel{
+			Matrix: []map[string]MatrixValues{
+				{
+					"GO_VERSION": {"1.13", "1.14"},
+					"OS":         {"alpine", "buster"},
+				},
+				{
+					"GO_VERSION": {"1.15"},
+				},
+			},
+		},
+	}
+
+	test.Equal(
+		[]map[string]string{
+			{"GO_VERSION": "1.13", "OS": "alpine"},
+			{"GO_VERSION": "1.13", "OS": "buster"},
+			{"GO_VERSION": "1.14", "OS": "alpine"},
+			{"GO_VERSION": "1.14", "OS": "buster"},
+			{"GO_VERSION": "1.15"},
+		},
+		job.GetVariants(),
+	)
+
+	test.Nil(Job{}.GetVariants())
+}
+
+func TestGetNeeds(t *testing.T) {
+	test := assert.New(t)
+
+	pipeline := Pipeline{
+		Stages: []string{"build", "test"},
+		Jobs: map[string]Job{
+			"build": {Stage: "build"},
+			"lint":  {Stage: "build"},
+			"test":  {Stage: "test"},
+			"e2e":   {Stage: "test", Needs: []string{"build"}},
+		},
+	}
+
+	test.Equal([]string{}, pipeline.GetNeeds("build"))
+	test.Equal([]string{"build", "lint"}, pipeline.GetNeeds("test"))
+	test.Equal([]string{"build"}, pipeline.GetNeeds("e2e"))
+	test.Nil(pipeline.GetNeeds("missing"))
+
+	// a job with unknown stage never needs itself
+	pipeline.Jobs["broken"] = Job{Stage: "deploy"}
+	test.NotContains(pipeline.GetNeeds("broken"), "broken")
+}
+
+func TestServiceGetAlias(t *testing.T) {
+	test := assert.New(t)
+
+	test.Equal("postgres", Service{Image: "postgres:13"}.GetAlias())
+	test.Equal("redis", Service{Image: "redis"}.GetAlias())
+	test.Equal(
+		"postgres",
+		Service{Image: "registry.example.com:5000/library/postgres:13"}.GetAlias(),
+	)
+	test.Equal("mysql", Service{Image: "mysql@sha256:abcdef"}.GetAlias())
+	test.Equal("db", Service{Image: "postgres:13", Alias: "db"}.GetAlias())
+}
+
+func TestJobIsIncluded(t *testing.T) {
+	test := assert.New(t)
+
+	master := Context{
+		RefType:   "BRANCH",
+		Ref:       "master",
+		Variables: map[string]string{"CI_BRANCH": "master", "DEPLOY": "true"},
+	}
+	feature := Context{
+		RefType:      "BRANCH",
+		Ref:          "feature/rules",
+		Variables:    map[string]string{"CI_BRANCH": "feature/rules"},
+		ChangedFiles: []string{"docs/index.md"},
+	}
+	tag := Context{
+		RefType:   "TAG",
+		Ref:       "v1.2.0",
+		Variables: map[string]string{"CI_TAG": "v1.2.0"},
+	}
+	pullRequest := Context{
+		RefType:       "BRANCH",
+		Ref:           "feature/rules",
+		PullRequestID: 7,
+		ChangedFiles:  []string{"cmd/snake-runner/main.go"},
+	}
+
+	test.True(Job{}.IsIncluded(feature))
+
+	only := Job{Only: Filter{Refs: []string{"master", "/^v\\d+/", "feature/*"}}}
+	test.True(only.IsIncluded(master))
+	test.True(only.IsIncluded(tag))
+	test.True(only.IsIncluded(feature))
+
+	only = Job{Only: Filter{Refs: []string{RefsTags, RefsPullRequests}}}
+	test.False(only.IsIncluded(master))
+	test.True(only.IsIncluded(tag))
+	test.True(only.IsIncluded(pullRequest))
+
+	except := Job{
+		Only:   Filter{Refs: []string{RefsBranches}},
+		Except: Filter{Changes: []string{"docs/**", "**/*.md"}},
+	}
+	test.True(except.IsIncluded(master))
+	test.False(except.IsIncluded(feature))
+	test.True(except.IsIncluded(pullRequest))
+	test.False(except.IsIncluded(tag))
+
+	variables := Job{Only: Filter{Variables: []string{`$DEPLOY == "true"`}}}
+	test.True(variables.IsIncluded(master))
+	test.False(variables.IsIncluded(feature))
+
+	rules := Job{
+		Rules: []Rule{
+			{If: `$CI_BRANCH =~ /^feature\//`, When: RuleWhenNever},
+			{If: `$CI_BRANCH == 'master' && $DEPLOY || $CI_TAG`},
+			{Changes: []string{"cmd/**/*.go"}},
+		},
+	}
+	test.True(rules.IsIncluded(master))
+	test.True(rules.IsIncluded(tag))
+	test.True(rules.IsIncluded(pullRequest))
+	test.False(rules.IsIncluded(feature))
+	test.False(rules.IsIncluded(Context{ChangedFiles: []string{"README.md"}}))
+	test.True(rules.IsIncluded(Context{}))
+}
+
+func TestParseExpression(t *testing.T) {
+	test := assert.New(t)
+
+	for _, text := range []string{
+		`$A`,
+		`${A} == "x"`,
+		`$A != 'x' && $B =~ /y/i || $C !~ /z/`,
+	} {
+		_, err := parseExpression(text)
+		test.NoError(err, text)
+	}
+
+	for _, text := range []string{
+		``,
+		`A`,
+		`$A ==`,
+		`$A == x`,
+		`$A =~ "x"`,
+		`$A &&`,
+		`$A $B`,
+		`$A == "x`,
+		`$A =~ /(/`,
+	} {
+		_, err := parseExpression(text)
+		test.Error(err, text)
+	}
+}
@@ -0,0 +1,498 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// RefsBranches matches all branches in refs of only/except.
+	RefsBranches = "branches"
+
+	// RefsTags matches all tags in refs of only/except.
+	RefsTags = "tags"
+
+	// RefsPullRequests matches all pipelines of pull requests in refs of
+	// only/except.
+	RefsPullRequests = "pull_requests"
+)
+
+const (
+	RuleWhenOnSuccess = "on_success"
+	RuleWhenNever     = "never"
+)
+
+// Context describes a pipeline which conditions of jobs are evaluated
+// against.
+type Context struct {
+	// RefType is BRANCH or TAG, Ref is a name of the branch or the tag.
+	RefType       string
+	Ref           string
+	PullRequestID int
+	Variables     map[string]string
+
+	// ChangedFiles are files changed by the pipeline, nil means that they
+	// are unknown and conditions on changes are resolved in favor of running
+	// the job.
+	ChangedFiles []string
+}
+
+// Filter is a set of conditions of only/except, the filter matches if every
+// specified kind of conditions has at least one matching condition.
+type Filter struct {
+	// Refs are names of branches and tags as glob patterns or regular
+	// expressions like /^release-.*$/, also keywords branches, tags and
+	// pull_requests are supported.
+	Refs []string `json:"refs" yaml:"refs"`
+
+	// Variables are expressions like $DEPLOY == "true".
+	Variables []string `json:"variables" yaml:"variables"`
+
+	// Changes are glob patterns of changed files, ** matches any number of
+	// directories.
+	Changes []string `json:"changes" yaml:"changes"`
+}
+
+// UnmarshalYAML accepts a list of refs as a short form.
+func (filter *Filter) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		*filter = Filter{}
+		return node.Decode(&filter.Refs)
+	}
+
+	type plain Filter
+
+	return node.Decode((*plain)(filter))
+}
+
+// IsEmpty returns true if the filter has no conditions.
+func (filter Filter) IsEmpty() bool {
+	return len(filter.Refs) == 0 &&
+		len(filter.Variables) == 0 &&
+		len(filter.Changes) == 0
+}
+
+// matches returns true if the filter matches the context, an empty filter
+// matches anything, unknownChanges is a result of conditions on changes if
+// changed files are unknown.
+func (filter Filter) matches(context Context, unknownChanges bool) bool {
+	if len(filter.Refs) > 0 && !matchRefs(filter.Refs, context) {
+		return false
+	}
+
+	if len(filter.Variables) > 0 {
+		matched := false
+		for _, text := range filter.Variables {
+			expression, _ := parseExpression(text)
+			if expression.evaluate(context.Variables) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	if len(filter.Changes) > 0 &&
+		!matchChanges(filter.Changes, context, unknownChanges) {
+		return false
+	}
+
+	return true
+}
+
+// Rule is a condition which decides whether the job runs, rules are
+// evaluated in order and the first matching rule wins.
+type Rule struct {
+	// If is an expression like $CI_BRANCH == "master" && $DEPLOY.
+	If      string   `json:"if"      yaml:"if"`
+	Changes []string `json:"changes" yaml:"changes"`
+
+	// When is on_success or never, on_success is used by default.
+	When string `json:"when" yaml:"when"`
+}
+
+// matches returns true if all conditions of the rule match the context.
+func (rule Rule) matches(context Context) bool {
+	if rule.If != "" {
+		expression, _ := parseExpression(rule.If)
+		if !expression.evaluate(context.Variables) {
+			return false
+		}
+	}
+
+	unknownChanges := rule.When != RuleWhenNever
+	if len(rule.Changes) > 0 &&
+		!matchChanges(rule.Changes, context, unknownChanges) {
+		return false
+	}
+
+	return true
+}
+
+// IsIncluded returns true if the job should run in the pipeline described by
+// the context. If the job has rules then the first matching rule decides and
+// the job doesn't run if no rule matches, otherwise only and except are
+// checked.
+func (job Job) IsIncluded(context Context) bool {
+	if len(job.Rules) > 0 {
+		for _, rule := range job.Rules {
+			if rule.matches(context) {
+				return rule.When != RuleWhenNever
+			}
+		}
+
+		return false
+	}
+
+	if !job.Only.IsEmpty() && !job.Only.matches(context, true) {
+		return false
+	}
+
+	if !job.Except.IsEmpty() && job.Except.matches(context, false) {
+		return false
+	}
+
+	return true
+}
+
+func matchRefs(refs []string, context Context) bool {
+	for _, ref := range refs {
+		switch ref {
+		case RefsBranches:
+			if context.RefType == "BRANCH" {
+				return true
+			}
+
+		case RefsTags:
+			if context.RefType == "TAG" {
+				return true
+			}
+
+		case RefsPullRequests:
+			if context.PullRequestID > 0 {
+				return true
+			}
+
+		default:
+			if matchPattern(ref, context.Ref) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func matchChanges(patterns []string, context Context, unknown bool) bool {
+	if context.ChangedFiles == nil {
+		return unknown
+	}
+
+	for _, pattern := range patterns {
+		glob := compileGlob(pattern)
+		for _, path := range context.ChangedFiles {
+			if glob.MatchString(path) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// matchPattern matches the value with a regular expression if the pattern
+// is enclosed in slashes or with a glob pattern otherwise.
+func matchPattern(pattern string, value string) bool {
+	if isRegexp(pattern) {
+		compiled, err := compileRegexp(pattern)
+		if err != nil {
+			return false
+		}
+
+		return compiled.MatchString(value)
+	}
+
+	return compileGlob(pattern).MatchString(value)
+}
+
+func isRegexp(pattern string) bool {
+	return strings.HasPrefix(pattern, "/") &&
+		(strings.HasSuffix(pattern[1:], "/") ||
+			strings.HasSuffix(pattern[1:], "/i"))
+}
+
+// compileRegexp compiles /regexp/ or /regexp/i for case insensitive
+// matching.
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	flags := ""
+	if strings.HasSuffix(pattern, "/i") {
+		flags = "(?i)"
+		pattern = strings.TrimSuffix(pattern, "i")
+	}
+
+	return regexp.Compile(flags + pattern[1:len(pattern)-1])
+}
+
+// compileGlob converts a glob pattern to a regular expression: * and ? don't
+// match slashes, ** matches anything including slashes.
+func compileGlob(pattern string) *regexp.Regexp {
+	result := "^"
+	for index := 0; index < len(pattern); index++ {
+		switch {
+		case strings.HasPrefix(pattern[index:], "**/"):
+			result += "(.*/)?"
+			index += 2
+		case strings.HasPrefix(pattern[index:], "**"):
+			result += ".*"
+			index++
+		case pattern[index] == '*':
+			result += "[^/]*"
+		case pattern[index] == '?':
+			result += "[^/]"
+		default:
+			result += regexp.QuoteMeta(pattern[index : index+1])
+		}
+	}
+
+	return regexp.MustCompile(result + "$")
+}
+
+// expression is a disjunction of conjunctions of conditions, && binds
+// tighter than ||.
+type expression [][]condition
+
+// condition is $VAR which is true if the variable is not empty or $VAR
+// compared with a string using == and != or with a regular expression using
+// =~ and !~.
+type condition struct {
+	variable string
+	operator string
+	value    string
+	pattern  *regexp.Regexp
+}
+
+func parseExpression(text string) (expression, error) {
+	tokens, err := tokenizeExpression(text)
+	if err != nil {
+		return nil, err
+	}
+
+	result := expression{}
+	conjunction := []condition{}
+	for len(tokens) > 0 {
+		if !strings.HasPrefix(tokens[0], "$") {
+			return nil, fmt.Errorf("expected variable, got %q", tokens[0])
+		}
+
+		current := condition{variable: strings.Trim(tokens[0], "${}")}
+		tokens = tokens[1:]
+
+		if len(tokens) > 0 {
+			switch tokens[0] {
+			case "==", "!=", "=~", "!~":
+				if len(tokens) < 2 {
+					return nil, fmt.Errorf("expected value after %s", tokens[0])
+				}
+
+				current.operator = tokens[0]
+				value := tokens[1]
+				tokens = tokens[2:]
+
+				if current.operator == "=~" || current.operator == "!~" {
+					if !isRegexp(value) {
+						return nil, fmt.Errorf(
+							"expected /regexp/ after %s, got %q",
+							current.operator, value,
+						)
+					}
+
+					current.pattern, err = compileRegexp(value)
+					if err != nil {
+						return nil, err
+					}
+				} else {
+					if !strings.HasPrefix(value, `"`) &&
+						!strings.HasPrefix(value, `'`) {
+						return nil, fmt.Errorf(
+							"expected quoted string after %s, got %q",
+							current.operator, value,
+						)
+					}
+
+					current.value = value[1 : len(value)-1]
+				}
+			}
+		}
+
+		conjunction = append(conjunction, current)
+
+		if len(tokens) == 0 {
+			break
+		}
+
+		switch tokens[0] {
+		case "&&":
+		case "||":
+			result = append(result, conjunction)
+			conjunction = []condition{}
+		default:
+			return nil, fmt.Errorf("expected && or ||, got %q", tokens[0])
+		}
+
+		tokens = tokens[1:]
+		if len(tokens) == 0 {
+			return nil, errors.New("unexpected end of expression")
+		}
+	}
+
+	if len(conjunction) == 0 {
+		return nil, errors.New("empty expression")
+	}
+
+	return append(result, conjunction), nil
+}
+
+func tokenizeExpression(text string) ([]string, error) {
+	tokens := []string{}
+	for index := 0; index < len(text); {
+		char := text[index]
+		switch {
+		case char == ' ' || char == '\t':
+			index++
+
+		case char == '"' || char == '\'' || char == '/':
+			end := index + 1
+			for end < len(text) && text[end] != char {
+				if text[end] == '\\' && char == '/' {
+					end++
+				}
+				end++
+			}
+
+			if end >= len(text) {
+				return nil, fmt.Errorf("unterminated %c at position %d", char, index)
+			}
+
+			end++
+			if char == '/' && end < len(text) && text[end] == 'i' {
+				end++
+			}
+
+			tokens = append(tokens, text[index:end])
+			index = end
+
+		case char == '$':
+			end := index + 1
+			for end < len(text) && strings.IndexByte(" \t=!&|", text[end]) == -1 {
+				end++
+			}
+
+			tokens = append(tokens, text[index:end])
+			index = end
+
+		default:
+			operator := ""
+			for _, candidate := range []string{"==", "!=", "=~", "!~", "&&", "||"} {
+				if strings.HasPrefix(text[index:], candidate) {
+					operator = candidate
+					break
+				}
+			}
+
+			if operator == "" {
+				return nil, fmt.Errorf("unexpected %q at position %d", text[index:], index)
+			}
+
+			tokens = append(tokens, operator)
+			index += len(operator)
+		}
+	}
+
+	return tokens, nil
+}
+
+func (expression expression) evaluate(variables map[string]string) bool {
+	for _, conjunction := range expression {
+		matched := true
+		for _, condition := range conjunction {
+			if !condition.evaluate(variables) {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (condition condition) evaluate(variables map[string]string) bool {
+	value := variables[condition.variable]
+
+	switch condition.operator {
+	case "==":
+		return value == condition.value
+	case "!=":
+		return value != condition.value
+	case "=~":
+		return condition.pattern.MatchString(value)
+	case "!~":
+		return !condition.pattern.MatchString(value)
+	default:
+		return value != ""
+	}
+}
+
+func validateRules(job Job) error {
+	if len(job.Rules) > 0 && (!job.Only.IsEmpty() || !job.Except.IsEmpty()) {
+		return errors.New("rules can't be used together with only/except")
+	}
+
+	for _, rule := range job.Rules {
+		if rule.If != "" {
+			_, err := parseExpression(rule.If)
+			if err != nil {
+				return fmt.Errorf("invalid rule if: %q: %s", rule.If, err)
+			}
+		}
+
+		switch rule.When {
+		case "", RuleWhenOnSuccess, RuleWhenNever:
+		default:
+			return fmt.Errorf(
+				"invalid rule when: %q, expected one of: %s, %s",
+				rule.When, RuleWhenOnSuccess, RuleWhenNever,
+			)
+		}
+	}
+
+	for _, filter := range []Filter{job.Only, job.Except} {
+		for _, ref := range filter.Refs {
+			if isRegexp(ref) {
+				_, err := compileRegexp(ref)
+				if err != nil {
+					return fmt.Errorf("invalid ref: %q: %s", ref, err)
+				}
+			}
+		}
+
+		for _, text := range filter.Variables {
+			_, err := parseExpression(text)
+			if err != nil {
+				return fmt.Errorf("invalid variables expression: %q: %s", text, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,285 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/snake-runner/internal/executor"
+)
+
+const (
+	// DockerHubRegistry is a host of images without explicit registry.
+	DockerHubRegistry = "docker.io"
+
+	// DockerHubServerAddress is the key of Docker Hub in docker config.json
+	// and credential helpers.
+	DockerHubServerAddress = "https://index.docker.io/v1/"
+)
+
+// Auth finds credentials of registries in the following order: credentials
+// given for a pull (per pipeline), credentials from runner config, docker
+// config.json including credential helpers.
+type Auth struct {
+	credentials map[string]executor.RegistryCredentials
+	configPath  string
+}
+
+type dockerConfig struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+}
+
+type dockerConfigAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+type helperCredentials struct {
+	Username string `json:"Username"`
+	Secret   string `json:"Secret"`
+}
+
+// NewAuth creates Auth, if configPath is empty then config.json is looked up
+// in $DOCKER_CONFIG or ~/.docker.
+func NewAuth(
+	credentials map[string]executor.RegistryCredentials,
+	configPath string,
+) *Auth {
+	if configPath == "" {
+		dir := os.Getenv("DOCKER_CONFIG")
+		if dir == "" {
+			home, err := os.UserHomeDir()
+			if err == nil {
+				dir = filepath.Join(home, ".docker")
+			}
+		}
+
+		if dir != "" {
+			configPath = filepath.Join(dir, "config.json")
+		}
+	}
+
+	return &Auth{
+		credentials: normalizeCredentials(credentials),
+		configPath:  configPath,
+	}
+}
+
+// Encode returns the value of RegistryAuth for pulling the given image, an
+// empty string means that no credentials found and the image is pulled
+// anonymously.
+func (auth *Auth) Encode(
+	image string,
+	credentials map[string]executor.RegistryCredentials,
+) (string, error) {
+	config, err := auth.Get(image, credentials)
+	if err != nil {
+		return "", err
+	}
+
+	if config == nil {
+		return "", nil
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+// Get returns credentials for the registry of the given image, nil is
+// returned if there are no credentials.
+func (auth *Auth) Get(
+	image string,
+	credentials map[string]executor.RegistryCredentials,
+) (*types.AuthConfig, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, karma.Format(err, "unable to parse image reference")
+	}
+
+	host := reference.Domain(named)
+	address := host
+	if host == DockerHubRegistry {
+		address = DockerHubServerAddress
+	}
+
+	for _, known := range []map[string]executor.RegistryCredentials{
+		normalizeCredentials(credentials),
+		auth.credentials,
+	} {
+		if found, ok := known[host]; ok {
+			return &types.AuthConfig{
+				Username:      found.Username,
+				Password:      found.Password,
+				ServerAddress: address,
+			}, nil
+		}
+	}
+
+	return auth.getFromConfig(host, address)
+}
+
+func (auth *Auth) getFromConfig(
+	host string,
+	address string,
+) (*types.AuthConfig, error) {
+	if auth.configPath == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(auth.configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, karma.Format(
+			err,
+			"unable to read docker config: %s", auth.configPath,
+		)
+	}
+
+	var config dockerConfig
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to decode docker config: %s", auth.configPath,
+		)
+	}
+
+	for key, helper := range config.CredHelpers {
+		if normalizeHost(key) == host {
+			return getFromHelper(helper, address)
+		}
+	}
+
+	for key, found := range config.Auths {
+		if normalizeHost(key) != host {
+			continue
+		}
+
+		result := &types.AuthConfig{
+			Username:      found.Username,
+			Password:      found.Password,
+			IdentityToken: found.IdentityToken,
+			ServerAddress: address,
+		}
+
+		if found.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(found.Auth)
+			if err != nil {
+				return nil, karma.Format(
+					err,
+					"unable to decode auth of registry %s in docker config",
+					key,
+				)
+			}
+
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return nil, karma.Format(
+					nil,
+					"invalid auth of registry %s in docker config",
+					key,
+				)
+			}
+
+			result.Username = parts[0]
+			result.Password = parts[1]
+		}
+
+		return result, nil
+	}
+
+	if config.CredsStore != "" {
+		return getFromHelper(config.CredsStore, address)
+	}
+
+	return nil, nil
+}
+
+// getFromHelper calls docker credential helper, the helper output contains
+// secrets so it's never included in errors.
+func getFromHelper(helper string, address string) (*types.AuthConfig, error) {
+	stdout := bytes.Buffer{}
+
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(address)
+	cmd.Stdout = &stdout
+
+	err := cmd.Run()
+	if err != nil {
+		if strings.Contains(stdout.String(), "credentials not found") {
+			return nil, nil
+		}
+
+		return nil, karma.Format(
+			err,
+			"unable to get credentials from docker credential helper: %s",
+			helper,
+		)
+	}
+
+	var credentials helperCredentials
+	err = json.Unmarshal(stdout.Bytes(), &credentials)
+	if err != nil {
+		return nil, karma.Format(
+			nil,
+			"unable to decode output of docker credential helper: %s",
+			helper,
+		)
+	}
+
+	result := &types.AuthConfig{ServerAddress: address}
+	if credentials.Username == "<token>" {
+		result.IdentityToken = credentials.Secret
+	} else {
+		result.Username = credentials.Username
+		result.Password = credentials.Secret
+	}
+
+	return result, nil
+}
+
+func normalizeCredentials(
+	credentials map[string]executor.RegistryCredentials,
+) map[string]executor.RegistryCredentials {
+	result := map[string]executor.RegistryCredentials{}
+	for host, value := range credentials {
+		result[normalizeHost(host)] = value
+	}
+
+	return result
+}
+
+// normalizeHost turns keys like https://index.docker.io/v1/ into hosts of
+// registries as they are in image references.
+func normalizeHost(key string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	if index := strings.Index(host, "/"); index != -1 {
+		host = host[:index]
+	}
+
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return DockerHubRegistry
+	}
+
+	return host
+}
@@ -0,0 +1,99 @@
+package docker
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/reconquest/snake-runner/internal/executor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthGet(t *testing.T) {
+	test := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "snake-docker-auth-")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(configPath, []byte(fmt.Sprintf(`{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": %q},
+			"config.example.com": {"auth": %q}
+		}
+	}`,
+		base64.StdEncoding.EncodeToString([]byte("hub:hubpass")),
+		base64.StdEncoding.EncodeToString([]byte("config:configpass")),
+	)), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	auth := NewAuth(
+		map[string]executor.RegistryCredentials{
+			"runner.example.com": {Username: "runner", Password: "runnerpass"},
+			"config.example.com": {Username: "runner", Password: "runnerpass"},
+		},
+		configPath,
+	)
+
+	pipeline := map[string]executor.RegistryCredentials{
+		"https://runner.example.com": {Username: "pipeline", Password: "pass"},
+	}
+
+	config, err := auth.Get("alpine", nil)
+	test.NoError(err)
+	test.Equal(
+		&types.AuthConfig{
+			Username:      "hub",
+			Password:      "hubpass",
+			ServerAddress: DockerHubServerAddress,
+		},
+		config,
+	)
+
+	config, err = auth.Get("runner.example.com/app:1", nil)
+	test.NoError(err)
+	test.Equal("runner", config.Username)
+
+	config, err = auth.Get("runner.example.com/app:1", pipeline)
+	test.NoError(err)
+	test.Equal("pipeline", config.Username)
+	test.Equal("runner.example.com", config.ServerAddress)
+
+	config, err = auth.Get("config.example.com/app", nil)
+	test.NoError(err)
+	test.Equal("runner", config.Username)
+
+	config, err = auth.Get("unknown.example.com/app", nil)
+	test.NoError(err)
+	test.Nil(config)
+
+	encoded, err := auth.Encode("unknown.example.com/app", nil)
+	test.NoError(err)
+	test.Empty(encoded)
+}
+
+func TestRegistryCredentialsAreHidden(t *testing.T) {
+	test := assert.New(t)
+
+	credentials := executor.RegistryCredentials{
+		Username: "user",
+		Password: "secret",
+	}
+
+	test.NotContains(fmt.Sprintf("%#v", credentials), "secret")
+	test.NotContains(fmt.Sprintf("%v", credentials), "secret")
+	test.NotContains(
+		fmt.Sprintf("%#v", map[string]executor.RegistryCredentials{"a": credentials}),
+		"secret",
+	)
+}
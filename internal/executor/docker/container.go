@@ -1,4 +1,4 @@
-package cloud
+package docker
 
 import (
 	"fmt"
@@ -7,11 +7,6 @@ import (
 	"github.com/docker/docker/api/types"
 )
 
-type Container struct {
-	Name string
-	ID   string
-}
-
 func (state *ContainerState) GetError() error {
 	data := []string{}
 	if state.ExitCode != 0 {
@@ -0,0 +1,653 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/docker/pkg/term"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+	"github.com/reconquest/snake-runner/internal/executor"
+)
+
+const (
+	ImageLabelKey = "io.reconquest.snake"
+
+	ContainerWaitInterval = time.Second
+
+	// ExitCodeKilled is an exit code of a process killed by SIGKILL.
+	ExitCodeKilled = 137
+)
+
+// OOMEventsScript prints events of the memory cgroup of the container, it's
+// memory.events for cgroup v2 and memory.oom_control for cgroup v1.
+const OOMEventsScript = `cat /sys/fs/cgroup/memory.events ` +
+	`/sys/fs/cgroup/memory/memory.oom_control 2>/dev/null; true`
+
+type Docker struct {
+	client client.APIClient
+	auth   *Auth
+
+	pulls      map[string]*pull
+	pullsMutex sync.Mutex
+
+	network string
+	volumes []string
+}
+
+var _ executor.Executor = (*Docker)(nil)
+
+func NewDocker(
+	network string,
+	volumes []string,
+	credentials map[string]executor.RegistryCredentials,
+	configPath string,
+) (*Docker, error) {
+	var err error
+
+	docker := &Docker{}
+
+	docker.network = network
+	docker.volumes = volumes
+	docker.auth = NewAuth(credentials, configPath)
+	docker.pulls = map[string]*pull{}
+
+	docker.client, err = client.NewClientWithOpts(client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to initialize docker client",
+		)
+	}
+
+	return docker, err
+}
+
+func (docker *Docker) Type() executor.Type {
+	return executor.TypeDocker
+}
+
+func (docker *Docker) EnsureImage(
+	ctx context.Context,
+	reference string,
+	policy executor.PullPolicy,
+	credentials map[string]executor.RegistryCredentials,
+	callback executor.OutputConsumer,
+) (*executor.Image, error) {
+	if !strings.Contains(reference, ":") {
+		reference = reference + ":latest"
+	}
+
+	image, err := docker.GetImageWithTag(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+
+	if image == nil && policy == executor.PullPolicyNever {
+		return nil, fmt.Errorf(
+			"image %s is not present and pull policy is %q",
+			reference, policy,
+		)
+	}
+
+	if image == nil || policy == executor.PullPolicyAlways {
+		callback(fmt.Sprintf("\n:: pulling docker image: %s\n", reference))
+
+		auth, err := docker.auth.Encode(reference, credentials)
+		if err != nil {
+			return nil, karma.Format(err, "unable to get registry credentials")
+		}
+
+		err = docker.pullImageOnce(ctx, reference, auth, callback)
+		if err != nil {
+			return nil, err
+		}
+
+		image, err = docker.GetImageWithTag(ctx, reference)
+		if err != nil {
+			return nil, karma.Format(err, "unable to get image after pulling")
+		}
+
+		if image == nil {
+			return nil, karma.Format(err, "image not found after pulling")
+		}
+	}
+
+	return &executor.Image{ID: image.ID, Tags: image.RepoTags}, nil
+}
+
+// PullImage pulls the image, auth is an encoded RegistryAuth, an empty string
+// means anonymous pull.
+func (docker *Docker) PullImage(
+	ctx context.Context,
+	reference string,
+	auth string,
+	callback executor.OutputConsumer,
+) error {
+	reader, err := docker.client.ImagePull(
+		ctx,
+		reference,
+		types.ImagePullOptions{RegistryAuth: auth},
+	)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	logwriter := executor.NewOutputWriter(callback)
+
+	termFd, isTerm := term.GetFdInfo(logwriter)
+
+	err = jsonmessage.DisplayJSONMessagesStream(
+		reader,
+		logwriter,
+		termFd,
+		isTerm,
+		nil,
+	)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to read docker pull output",
+		)
+	}
+
+	return nil
+}
+
+func (docker *Docker) ListImages(
+	ctx context.Context,
+) ([]types.ImageSummary, error) {
+	images, err := docker.client.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+func (docker *Docker) CreateContainer(
+	ctx context.Context,
+	config executor.ContainerConfig,
+) (*executor.Container, error) {
+	containerConfig := &container.Config{
+		Image: config.Image,
+		Labels: map[string]string{
+			ImageLabelKey: "true",
+		},
+		Env:          config.Env,
+		User:         config.Security.User,
+		AttachStdout: true,
+		AttachStderr: true,
+		AttachStdin:  true,
+		Tty:          true,
+	}
+
+	hostConfig := &container.HostConfig{
+		Binds:   append(append([]string{}, docker.volumes...), config.Volumes...),
+		ShmSize: config.Resources.ShmSize,
+
+		Privileged:     config.Security.Privileged,
+		CapAdd:         config.Security.CapAdd,
+		CapDrop:        config.Security.CapDrop,
+		SecurityOpt:    config.Security.SecurityOpt,
+		ReadonlyRootfs: config.Security.ReadOnly,
+		Tmpfs:          config.Security.Tmpfs,
+	}
+
+	hostConfig.Resources.NanoCPUs = int64(config.Resources.CPUs * 1e9)
+	hostConfig.Resources.Memory = config.Resources.Memory
+	if config.Resources.Pids > 0 {
+		hostConfig.Resources.PidsLimit = &config.Resources.Pids
+	}
+
+	switch {
+	case config.DefaultNetwork != "":
+		hostConfig.NetworkMode = container.NetworkMode(config.DefaultNetwork)
+	case docker.network != "":
+		hostConfig.NetworkMode = container.NetworkMode(docker.network)
+	}
+
+	// the container can't be connected to other networks if it uses network
+	// of the host, in such case the given network replaces the default one
+	var networkingConfig *network.NetworkingConfig
+	if config.Network != "" &&
+		(hostConfig.NetworkMode.IsHost() || hostConfig.NetworkMode.IsNone()) {
+		hostConfig.NetworkMode = container.NetworkMode(config.Network)
+		networkingConfig = &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				config.Network: {Aliases: config.Aliases},
+			},
+		}
+	}
+
+	created, err := docker.client.ContainerCreate(
+		ctx, containerConfig,
+		hostConfig, networkingConfig, config.Name,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	id := created.ID
+
+	if config.Network != "" && networkingConfig == nil {
+		err = docker.client.NetworkConnect(
+			ctx, config.Network, id,
+			&network.EndpointSettings{Aliases: config.Aliases},
+		)
+		if err != nil {
+			_ = docker.DestroyContainer(ctx, &executor.Container{ID: id})
+
+			return nil, karma.Format(
+				err,
+				"unable to connect container to network %q",
+				config.Network,
+			)
+		}
+	}
+
+	err = docker.client.ContainerStart(ctx, id, types.ContainerStartOptions{})
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to start created container",
+		)
+	}
+
+	return &executor.Container{ID: id, Name: config.Name}, nil
+}
+
+func (docker *Docker) WaitContainer(
+	ctx context.Context,
+	container *executor.Container,
+) error {
+	for {
+		state, err := docker.InspectContainer(ctx, container)
+		if err != nil {
+			return err
+		}
+
+		if !state.Running {
+			err := state.GetError()
+			if err == nil {
+				err = fmt.Errorf("status: %s", state.Status)
+			}
+
+			return karma.Format(err, "container is not running")
+		}
+
+		if state.Health == nil || state.Health.Status == types.Healthy {
+			return nil
+		}
+
+		if state.Health.Status == types.Unhealthy {
+			return errors.New("container is unhealthy")
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(ContainerWaitInterval):
+		}
+	}
+}
+
+func (docker *Docker) CreateNetwork(
+	ctx context.Context,
+	name string,
+) (*executor.Network, error) {
+	created, err := docker.client.NetworkCreate(
+		ctx, name,
+		types.NetworkCreate{
+			CheckDuplicate: true,
+			Labels: map[string]string{
+				ImageLabelKey: "true",
+			},
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &executor.Network{ID: created.ID, Name: name}, nil
+}
+
+// DestroyNetwork disconnects all containers from the network and removes it,
+// the containers themselves are not destroyed. Containers which are removed
+// or disconnected at the same time don't prevent removing the network.
+func (docker *Docker) DestroyNetwork(
+	ctx context.Context,
+	network *executor.Network,
+) error {
+	if network == nil {
+		return nil
+	}
+
+	inspect, err := docker.client.NetworkInspect(
+		ctx, network.ID,
+		types.NetworkInspectOptions{},
+	)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil
+		}
+
+		return karma.Format(err, "unable to inspect network")
+	}
+
+	for id := range inspect.Containers {
+		err := docker.client.NetworkDisconnect(ctx, network.ID, id, true)
+		if err != nil && !isNotConnected(err) {
+			log.Errorf(
+				karma.Describe("network", network.Name).
+					Describe("container", id).
+					Reason(err),
+				"unable to disconnect container from network",
+			)
+		}
+	}
+
+	err = docker.client.NetworkRemove(ctx, network.ID)
+	if err != nil && !client.IsErrNotFound(err) {
+		return karma.Format(err, "unable to remove network")
+	}
+
+	return nil
+}
+
+// isNotConnected returns true if the container has been removed or
+// disconnected from the network already.
+func isNotConnected(err error) bool {
+	return client.IsErrNotFound(err) ||
+		strings.Contains(err.Error(), "is not connected")
+}
+
+func (docker *Docker) InspectContainer(
+	ctx context.Context,
+	container *executor.Container,
+) (*ContainerState, error) {
+	response, err := docker.client.ContainerInspect(ctx, container.ID)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to inspect container",
+		)
+	}
+
+	return &ContainerState{*response.State}, nil
+}
+
+func (docker *Docker) DestroyContainer(
+	ctx context.Context,
+	container *executor.Container,
+) error {
+	if container == nil {
+		return nil
+	}
+
+	err := docker.client.ContainerRemove(
+		ctx, container.ID,
+		types.ContainerRemoveOptions{
+			Force: true,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (docker *Docker) Exec(
+	ctx context.Context,
+	container *executor.Container,
+	config executor.ExecConfig,
+	callback executor.OutputConsumer,
+) error {
+	exec, err := docker.client.ContainerExecCreate(
+		ctx,
+		container.ID,
+		types.ExecConfig{
+			Cmd:          config.Cmd,
+			Env:          config.Env,
+			WorkingDir:   config.WorkingDir,
+			AttachStdout: config.AttachStdout,
+			AttachStderr: config.AttachStderr,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	response, err := docker.client.ContainerExecAttach(
+		ctx, exec.ID,
+		types.ExecStartCheck{},
+	)
+	if err != nil {
+		return err
+	}
+
+	defer response.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			// hijacked connection doesn't respect context after dial, so it
+			// needs to be closed explicitly to interrupt reading
+			response.Close()
+		case <-done:
+		}
+	}()
+
+	writer := executor.NewOutputWriter(callback)
+
+	_, err = stdcopy.StdCopy(writer, writer, response.Reader)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return karma.Format(err, "unable to read stdout of exec/attach")
+	}
+
+	info, err := docker.client.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to inspect container/exec",
+		)
+	}
+	if info.ExitCode > 0 {
+		reason := executor.ErrNonZeroExitCode
+		if docker.isOOMKilled(ctx, container, info.ExitCode) {
+			reason = executor.ErrOOMKilled
+		}
+
+		return karma.
+			Describe("exitcode", info.ExitCode).
+			Reason(reason)
+	}
+
+	return nil
+}
+
+// isOOMKilled returns true if the process has been killed by the OOM killer,
+// docker sets OOMKilled only if the container itself is dead, a killed exec
+// process is detected by SIGKILL exit code and the oom_kill counter of the
+// memory cgroup of the container. Reaching the memory limit (failcnt) alone
+// doesn't mean that anything has been killed.
+func (docker *Docker) isOOMKilled(
+	ctx context.Context,
+	container *executor.Container,
+	exitCode int,
+) bool {
+	state, err := docker.InspectContainer(ctx, container)
+	if err != nil {
+		return false
+	}
+
+	if state.OOMKilled {
+		return true
+	}
+
+	if exitCode != ExitCodeKilled {
+		return false
+	}
+
+	events := strings.Builder{}
+	err = docker.Exec(
+		ctx,
+		container,
+		executor.ExecConfig{
+			Cmd:          []string{"sh", "-c", OOMEventsScript},
+			AttachStdout: true,
+		},
+		func(text string) {
+			events.WriteString(text)
+		},
+	)
+	if err != nil {
+		return false
+	}
+
+	return parseOOMKills(events.String()) > 0
+}
+
+// parseOOMKills returns value of the oom_kill counter from output of
+// OOMEventsScript, the counter has the same format in both files.
+func parseOOMKills(events string) int64 {
+	for _, line := range strings.Split(events, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "oom_kill" {
+			continue
+		}
+
+		kills, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0
+		}
+
+		return kills
+	}
+
+	return 0
+}
+
+func (docker *Docker) Cleanup(ctx context.Context) error {
+	options := types.ContainerListOptions{}
+
+	containers, err := docker.client.ContainerList(
+		ctx,
+		options,
+	)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to list containers",
+		)
+	}
+
+	destroyed := 0
+	for _, container := range containers {
+		if _, ours := container.Labels[ImageLabelKey]; ours {
+			log.Infof(
+				nil,
+				"cleanup: destroying container %q %q in status: %s",
+				container.ID,
+				container.Names,
+				container.Status,
+			)
+
+			err := docker.DestroyContainer(ctx, &executor.Container{ID: container.ID})
+			if err != nil {
+				log.Errorf(
+					karma.Describe("id", container.ID).
+						Describe("name", container.Names).Reason(err),
+					"unable to destroy container",
+				)
+			}
+
+			destroyed++
+		}
+	}
+
+	log.Infof(nil, "cleanup: destroyed %d containers", destroyed)
+
+	networks, err := docker.client.NetworkList(
+		ctx,
+		types.NetworkListOptions{
+			Filters: filters.NewArgs(filters.Arg("label", ImageLabelKey)),
+		},
+	)
+	if err != nil {
+		return karma.Format(
+			err,
+			"unable to list networks",
+		)
+	}
+
+	for _, network := range networks {
+		log.Infof(
+			nil,
+			"cleanup: destroying network %q %q",
+			network.ID,
+			network.Name,
+		)
+
+		err := docker.DestroyNetwork(
+			ctx,
+			&executor.Network{ID: network.ID, Name: network.Name},
+		)
+		if err != nil {
+			log.Errorf(
+				karma.Describe("id", network.ID).
+					Describe("name", network.Name).Reason(err),
+				"unable to destroy network",
+			)
+		}
+	}
+
+	log.Infof(nil, "cleanup: destroyed %d networks", len(networks))
+
+	return nil
+}
+
+func (docker *Docker) GetImageWithTag(
+	ctx context.Context,
+	tag string,
+) (*types.ImageSummary, error) {
+	images, err := docker.ListImages(ctx)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to list images",
+		)
+	}
+
+	for _, image := range images {
+		for _, repoTag := range image.RepoTags {
+			if repoTag == tag ||
+				(!strings.Contains(tag, ":") && strings.HasPrefix(repoTag, tag+":")) {
+				return &image, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
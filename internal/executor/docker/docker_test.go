@@ -0,0 +1,272 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/reconquest/snake-runner/internal/executor"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClient implements only methods of docker API which are used by tests,
+// other methods panic.
+type fakeClient struct {
+	client.APIClient
+
+	mutex sync.Mutex
+	calls []string
+
+	networkContainers map[string]types.EndpointResource
+	disconnectErrors  map[string]error
+
+	oomKilled bool
+
+	pulls       int
+	pullRelease chan struct{}
+	pullOutput  string
+	pullErr     error
+}
+
+func (fake *fakeClient) ImagePull(
+	ctx context.Context,
+	reference string,
+	options types.ImagePullOptions,
+) (io.ReadCloser, error) {
+	fake.call("pull %s", reference)
+
+	fake.mutex.Lock()
+	fake.pulls++
+	fake.mutex.Unlock()
+
+	<-fake.pullRelease
+
+	if fake.pullErr != nil {
+		return nil, fake.pullErr
+	}
+
+	return ioutil.NopCloser(strings.NewReader(fake.pullOutput)), nil
+}
+
+func (fake *fakeClient) ContainerInspect(
+	ctx context.Context,
+	container string,
+) (types.ContainerJSON, error) {
+	fake.call("inspect %s", container)
+
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    container,
+			State: &types.ContainerState{OOMKilled: fake.oomKilled},
+		},
+	}, nil
+}
+
+func (fake *fakeClient) call(format string, args ...interface{}) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.calls = append(fake.calls, fmt.Sprintf(format, args...))
+}
+
+func (fake *fakeClient) NetworkInspect(
+	ctx context.Context,
+	network string,
+	options types.NetworkInspectOptions,
+) (types.NetworkResource, error) {
+	fake.call("inspect %s", network)
+
+	return types.NetworkResource{
+		ID:         network,
+		Containers: fake.networkContainers,
+	}, nil
+}
+
+func (fake *fakeClient) NetworkDisconnect(
+	ctx context.Context,
+	network string,
+	container string,
+	force bool,
+) error {
+	fake.call("disconnect %s %s", network, container)
+
+	return fake.disconnectErrors[container]
+}
+
+func (fake *fakeClient) NetworkRemove(ctx context.Context, network string) error {
+	fake.call("remove %s", network)
+
+	return nil
+}
+
+func TestDestroyNetworkRemovesNetworkOfRemovedContainers(t *testing.T) {
+	test := assert.New(t)
+
+	fake := &fakeClient{
+		networkContainers: map[string]types.EndpointResource{
+			"alive":        {},
+			"removed":      {},
+			"disconnected": {},
+		},
+		disconnectErrors: map[string]error{
+			"removed": errdefs.NotFound(errors.New("no such container")),
+			"disconnected": errors.New(
+				"container disconnected is not connected to network net",
+			),
+		},
+	}
+
+	docker := &Docker{client: fake}
+
+	err := docker.DestroyNetwork(
+		context.Background(),
+		&executor.Network{ID: "net", Name: "net"},
+	)
+	test.NoError(err)
+
+	sort.Strings(fake.calls[1:4])
+	test.Equal(
+		[]string{
+			"inspect net",
+			"disconnect net alive",
+			"disconnect net disconnected",
+			"disconnect net removed",
+			"remove net",
+		},
+		fake.calls,
+	)
+}
+
+func TestParseOOMKills(t *testing.T) {
+	test := assert.New(t)
+
+	// memory.events of cgroup v2
+	test.EqualValues(2, parseOOMKills(
+		"low 0\nhigh 0\nmax 12\noom 2\noom_kill 2\noom_group_kill 0\n",
+	))
+
+	// memory.oom_control of cgroup v1
+	test.EqualValues(1, parseOOMKills(
+		"oom_kill_disable 0\nunder_oom 0\noom_kill 1\n",
+	))
+
+	// the limit has been reached, but nothing has been killed
+	test.EqualValues(0, parseOOMKills("low 0\nhigh 0\nmax 7\noom 0\noom_kill 0\n"))
+
+	// neither of files is available
+	test.EqualValues(0, parseOOMKills(""))
+}
+
+func TestIsOOMKilledByContainerState(t *testing.T) {
+	test := assert.New(t)
+
+	fake := &fakeClient{}
+	docker := &Docker{client: fake}
+	container := &executor.Container{ID: "job"}
+
+	test.False(docker.isOOMKilled(context.Background(), container, 1))
+
+	fake.oomKilled = true
+
+	test.True(docker.isOOMKilled(context.Background(), container, 1))
+}
+
+// pullConcurrently pulls the image by given number of jobs at the same time,
+// the pull is finished only when all jobs are waiting for it.
+func pullConcurrently(
+	docker *Docker,
+	fake *fakeClient,
+	jobs int,
+) ([]string, []error) {
+	outputs := make([]string, jobs)
+	errs := make([]error, jobs)
+	waiting := make(chan struct{}, jobs)
+
+	workers := sync.WaitGroup{}
+	for index := 0; index < jobs; index++ {
+		workers.Add(1)
+		go func(index int) {
+			defer workers.Done()
+
+			errs[index] = docker.pullImageOnce(
+				context.Background(),
+				"alpine:3.12",
+				"",
+				func(text string) {
+					if strings.Contains(text, "waiting for pull") {
+						waiting <- struct{}{}
+						return
+					}
+
+					outputs[index] += text
+				},
+			)
+		}(index)
+	}
+
+	for index := 1; index < jobs; index++ {
+		<-waiting
+	}
+
+	close(fake.pullRelease)
+	workers.Wait()
+
+	return outputs, errs
+}
+
+func TestPullImageOnceCoalescesPulls(t *testing.T) {
+	test := assert.New(t)
+
+	fake := &fakeClient{
+		pullRelease: make(chan struct{}),
+		pullOutput:  `{"status":"Pulling from library/alpine"}` + "\n",
+	}
+
+	docker := &Docker{client: fake, pulls: map[string]*pull{}}
+
+	outputs, errs := pullConcurrently(docker, fake, 3)
+
+	test.Equal(1, fake.pulls)
+	for index := range outputs {
+		test.NoError(errs[index])
+		test.Equal("Pulling from library/alpine\n", outputs[index])
+	}
+
+	test.Empty(docker.pulls)
+}
+
+func TestPullImageOnceReturnsErrorToAllJobs(t *testing.T) {
+	test := assert.New(t)
+
+	fake := &fakeClient{
+		pullRelease: make(chan struct{}),
+		pullErr:     errors.New("registry is unavailable"),
+	}
+
+	docker := &Docker{client: fake, pulls: map[string]*pull{}}
+
+	_, errs := pullConcurrently(docker, fake, 3)
+
+	test.Equal(1, fake.pulls)
+	for _, err := range errs {
+		test.EqualError(err, "registry is unavailable")
+	}
+
+	// the failed pull is forgotten, so the next job tries again
+	fake.pullRelease = make(chan struct{})
+	fake.pullErr = nil
+
+	_, errs = pullConcurrently(docker, fake, 1)
+
+	test.Equal(2, fake.pulls)
+	test.NoError(errs[0])
+}
@@ -0,0 +1,112 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/snake-runner/internal/executor"
+)
+
+// pull is an image pull shared by all jobs which need the same image at the
+// same time, output of the pull is sent to all of them.
+type pull struct {
+	done chan struct{}
+	err  error
+
+	mutex     sync.Mutex
+	callbacks map[int]executor.OutputConsumer
+	counter   int
+}
+
+func (pull *pull) subscribe(callback executor.OutputConsumer) int {
+	pull.mutex.Lock()
+	defer pull.mutex.Unlock()
+
+	pull.counter++
+	pull.callbacks[pull.counter] = callback
+
+	return pull.counter
+}
+
+func (pull *pull) unsubscribe(id int) {
+	pull.mutex.Lock()
+	defer pull.mutex.Unlock()
+
+	delete(pull.callbacks, id)
+}
+
+func (pull *pull) write(text string) {
+	pull.mutex.Lock()
+	defer pull.mutex.Unlock()
+
+	for _, callback := range pull.callbacks {
+		callback(text)
+	}
+}
+
+// pullImageOnce pulls the image or waits for the pull of the same image
+// which is already in progress.
+func (docker *Docker) pullImageOnce(
+	ctx context.Context,
+	reference string,
+	auth string,
+	callback executor.OutputConsumer,
+) error {
+	key := reference + "\x00" + auth
+
+	for {
+		docker.pullsMutex.Lock()
+		current, inProgress := docker.pulls[key]
+		if !inProgress {
+			current = &pull{
+				done:      make(chan struct{}),
+				callbacks: map[int]executor.OutputConsumer{},
+			}
+
+			docker.pulls[key] = current
+		}
+		docker.pullsMutex.Unlock()
+
+		id := current.subscribe(callback)
+
+		if !inProgress {
+			current.err = docker.PullImage(ctx, reference, auth, current.write)
+
+			docker.pullsMutex.Lock()
+			delete(docker.pulls, key)
+			docker.pullsMutex.Unlock()
+
+			current.unsubscribe(id)
+			close(current.done)
+
+			return current.err
+		}
+
+		callback(
+			fmt.Sprintf(
+				"\n:: waiting for pull of docker image started by another job: %s\n",
+				reference,
+			),
+		)
+
+		select {
+		case <-ctx.Done():
+			current.unsubscribe(id)
+			return ctx.Err()
+		case <-current.done:
+			current.unsubscribe(id)
+		}
+
+		// the job which started the pull has been canceled, but this one
+		// still needs the image
+		if current.err != nil &&
+			(karma.Contains(current.err, context.Canceled) ||
+				karma.Contains(current.err, context.DeadlineExceeded)) {
+			continue
+		}
+
+		return current.err
+	}
+}
@@ -0,0 +1,210 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrNonZeroExitCode is a reason of errors returned by Exec when the executed
+// command finished with non-zero exit code.
+var ErrNonZeroExitCode = errors.New("exitcode is greater than zero")
+
+// ErrOOMKilled is a reason of errors returned by Exec when the container has
+// been killed because it exceeded its memory limit.
+var ErrOOMKilled = errors.New("killed by out of memory killer")
+
+type (
+	OutputConsumer  func(string)
+	CommandConsumer func([]string)
+)
+
+// Executor is a backend that runs pipelines: it prepares images, creates
+// isolated environments (containers) and executes commands in them.
+type Executor interface {
+	Type() Type
+
+	// EnsureImage pulls the image if it's not present yet, given credentials
+	// are keyed by registry host and take precedence over credentials known
+	// to the executor.
+	EnsureImage(
+		ctx context.Context,
+		reference string,
+		policy PullPolicy,
+		credentials map[string]RegistryCredentials,
+		callback OutputConsumer,
+	) (*Image, error)
+
+	CreateContainer(
+		ctx context.Context,
+		config ContainerConfig,
+	) (*Container, error)
+
+	// WaitContainer waits until the container is running and healthy if the
+	// container has a health check.
+	WaitContainer(ctx context.Context, container *Container) error
+
+	Exec(
+		ctx context.Context,
+		container *Container,
+		config ExecConfig,
+		callback OutputConsumer,
+	) error
+
+	DestroyContainer(ctx context.Context, container *Container) error
+
+	// CreateNetwork creates an isolated network, nil is returned if the
+	// executor doesn't support networks. Networks are removed by Cleanup if
+	// they are leaked.
+	CreateNetwork(ctx context.Context, name string) (*Network, error)
+
+	DestroyNetwork(ctx context.Context, network *Network) error
+
+	Cleanup(ctx context.Context) error
+}
+
+// PullPolicy defines when an image is pulled.
+type PullPolicy string
+
+const (
+	// PullPolicyAlways pulls the image every time, so moving tags like
+	// latest are always up to date.
+	PullPolicyAlways PullPolicy = "always"
+
+	// PullPolicyIfNotPresent pulls the image only if it's not present.
+	PullPolicyIfNotPresent PullPolicy = "if-not-present"
+
+	// PullPolicyNever never pulls the image, it must be present already.
+	PullPolicyNever PullPolicy = "never"
+)
+
+// Validate returns an error if the policy is unknown, an empty policy is
+// valid and means that the default one is used.
+func (policy PullPolicy) Validate() error {
+	switch policy {
+	case "", PullPolicyAlways, PullPolicyIfNotPresent, PullPolicyNever:
+		return nil
+	}
+
+	return fmt.Errorf(
+		"invalid pull policy: %q, expected one of: %s, %s, %s",
+		string(policy),
+		PullPolicyAlways, PullPolicyIfNotPresent, PullPolicyNever,
+	)
+}
+
+type Type string
+
+const (
+	TypeDocker Type = "docker"
+	TypeShell  Type = "shell"
+)
+
+type Container struct {
+	Name string
+	ID   string
+}
+
+type ContainerConfig struct {
+	Image   string
+	Name    string
+	Volumes []string
+	Env     []string
+
+	// DefaultNetwork replaces the default network of the executor, it's used
+	// to isolate containers of a pipeline from other pipelines.
+	DefaultNetwork string
+
+	// Network is connected to the container in addition to the default
+	// network of the executor, the container is resolvable in the network by
+	// given aliases.
+	Network string
+	Aliases []string
+
+	Resources Resources
+	Security  Security
+}
+
+// Security holds security options of a container, zero value means defaults
+// of the executor.
+type Security struct {
+	Privileged  bool
+	CapAdd      []string
+	CapDrop     []string
+	SecurityOpt []string
+
+	// ReadOnly mounts the root filesystem of the container as read only,
+	// Tmpfs are writable mounts by path with mount options as values.
+	ReadOnly bool
+	Tmpfs    map[string]string
+
+	User string
+}
+
+// Resources limit resources available to a container, zero values mean no
+// limit.
+type Resources struct {
+	CPUs    float64
+	Memory  int64
+	Pids    int64
+	ShmSize int64
+}
+
+// Limit returns resources where every value is capped by the given limits,
+// missing values are limited too.
+func (resources Resources) Limit(max Resources) Resources {
+	if max.CPUs > 0 && (resources.CPUs == 0 || resources.CPUs > max.CPUs) {
+		resources.CPUs = max.CPUs
+	}
+
+	if max.Memory > 0 && (resources.Memory == 0 || resources.Memory > max.Memory) {
+		resources.Memory = max.Memory
+	}
+
+	if max.Pids > 0 && (resources.Pids == 0 || resources.Pids > max.Pids) {
+		resources.Pids = max.Pids
+	}
+
+	if max.ShmSize > 0 && (resources.ShmSize == 0 || resources.ShmSize > max.ShmSize) {
+		resources.ShmSize = max.ShmSize
+	}
+
+	return resources
+}
+
+// RegistryCredentials are used to pull images from private registries.
+type RegistryCredentials struct {
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+}
+
+// GoString hides the password when credentials are printed with %#v.
+func (credentials RegistryCredentials) GoString() string {
+	return fmt.Sprintf(
+		"executor.RegistryCredentials{Username:%q, Password:<hidden>}",
+		credentials.Username,
+	)
+}
+
+// String hides the password when credentials are printed with %v.
+func (credentials RegistryCredentials) String() string {
+	return "{" + credentials.Username + " <hidden>}"
+}
+
+type Network struct {
+	Name string
+	ID   string
+}
+
+type Image struct {
+	ID   string
+	Tags []string
+}
+
+type ExecConfig struct {
+	Cmd          []string
+	Env          []string
+	WorkingDir   string
+	AttachStdout bool
+	AttachStderr bool
+}
@@ -0,0 +1,243 @@
+package shell
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/snake-runner/internal/executor"
+)
+
+// PrivateEnvPrefix is a prefix of runner's own environment variables, such
+// variables contain secrets and never passed to executed commands.
+const PrivateEnvPrefix = "SNAKE_"
+
+// Shell executes commands directly on the local host without any kind of
+// isolation, containers are just names which are used to track processes.
+type Shell struct {
+	mutex     sync.Mutex
+	processes map[string]map[int]struct{}
+}
+
+var _ executor.Executor = (*Shell)(nil)
+
+func NewShell() *Shell {
+	return &Shell{
+		processes: map[string]map[int]struct{}{},
+	}
+}
+
+func (shell *Shell) Type() executor.Type {
+	return executor.TypeShell
+}
+
+// EnsureImage does nothing because images are not used by local shell.
+func (shell *Shell) EnsureImage(
+	ctx context.Context,
+	reference string,
+	policy executor.PullPolicy,
+	credentials map[string]executor.RegistryCredentials,
+	callback executor.OutputConsumer,
+) (*executor.Image, error) {
+	return nil, nil
+}
+
+func (shell *Shell) CreateContainer(
+	ctx context.Context,
+	config executor.ContainerConfig,
+) (*executor.Container, error) {
+	return &executor.Container{ID: config.Name, Name: config.Name}, nil
+}
+
+// WaitContainer does nothing because processes are started only by Exec.
+func (shell *Shell) WaitContainer(
+	ctx context.Context,
+	container *executor.Container,
+) error {
+	return nil
+}
+
+// CreateNetwork does nothing because local shell uses network of the host.
+func (shell *Shell) CreateNetwork(
+	ctx context.Context,
+	name string,
+) (*executor.Network, error) {
+	return nil, nil
+}
+
+func (shell *Shell) DestroyNetwork(
+	ctx context.Context,
+	network *executor.Network,
+) error {
+	return nil
+}
+
+func (shell *Shell) DestroyContainer(
+	ctx context.Context,
+	container *executor.Container,
+) error {
+	if container == nil {
+		return nil
+	}
+
+	shell.mutex.Lock()
+	defer shell.mutex.Unlock()
+
+	// kill everything that has been left running in background
+	for pgid := range shell.processes[container.ID] {
+		err := syscall.Kill(-pgid, syscall.SIGKILL)
+		if err != nil && err != syscall.ESRCH {
+			return karma.Format(
+				err,
+				"unable to kill process group: %d", pgid,
+			)
+		}
+	}
+
+	delete(shell.processes, container.ID)
+
+	return nil
+}
+
+func (shell *Shell) Exec(
+	ctx context.Context,
+	container *executor.Container,
+	config executor.ExecConfig,
+	callback executor.OutputConsumer,
+) error {
+	if len(config.Cmd) == 0 {
+		return karma.Format(nil, "no command specified")
+	}
+
+	cmd := exec.Command(config.Cmd[0], config.Cmd[1:]...)
+	cmd.Dir = config.WorkingDir
+	cmd.Env = append(getPublicEnv(), config.Env...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// the output goes through a pipe of our own instead of the one created
+	// by exec, otherwise Wait would wait for processes left running in
+	// background because they keep the output open
+	var output, input *os.File
+	if config.AttachStdout || config.AttachStderr {
+		var err error
+		output, input, err = os.Pipe()
+		if err != nil {
+			return karma.Format(err, "unable to create pipe for output")
+		}
+
+		defer output.Close()
+		defer input.Close()
+
+		if config.AttachStdout {
+			cmd.Stdout = input
+		}
+		if config.AttachStderr {
+			cmd.Stderr = input
+		}
+	}
+
+	err := cmd.Start()
+	if err != nil {
+		return karma.Describe("cmd", config.Cmd).Format(
+			err,
+			"unable to start command",
+		)
+	}
+
+	pgid := cmd.Process.Pid
+
+	shell.track(container, pgid)
+	defer shell.untrack(container, pgid)
+
+	copied := make(chan struct{})
+	if output != nil {
+		// the command has its own copy of the pipe, so the output ends as
+		// soon as the command and its children are gone
+		input.Close()
+
+		go func() {
+			defer close(copied)
+
+			_, _ = io.Copy(executor.NewOutputWriter(callback), output)
+		}()
+	} else {
+		close(copied)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+
+	err = cmd.Wait()
+
+	// processes left running in background are not needed after the command
+	// is finished
+	syscall.Kill(-pgid, syscall.SIGKILL)
+
+	<-copied
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return karma.
+				Describe("exitcode", exitErr.ExitCode()).
+				Reason(executor.ErrNonZeroExitCode)
+		}
+
+		return karma.Format(err, "unable to wait for command")
+	}
+
+	return nil
+}
+
+// Cleanup does nothing because all processes started by previous instances
+// of runner are gone together with their parent.
+func (shell *Shell) Cleanup(ctx context.Context) error {
+	return nil
+}
+
+func (shell *Shell) track(container *executor.Container, pgid int) {
+	shell.mutex.Lock()
+	defer shell.mutex.Unlock()
+
+	if _, ok := shell.processes[container.ID]; !ok {
+		shell.processes[container.ID] = map[int]struct{}{}
+	}
+
+	shell.processes[container.ID][pgid] = struct{}{}
+}
+
+func (shell *Shell) untrack(container *executor.Container, pgid int) {
+	shell.mutex.Lock()
+	defer shell.mutex.Unlock()
+
+	delete(shell.processes[container.ID], pgid)
+}
+
+func getPublicEnv() []string {
+	env := []string{}
+	for _, value := range os.Environ() {
+		if strings.HasPrefix(value, PrivateEnvPrefix) {
+			continue
+		}
+
+		env = append(env, value)
+	}
+
+	return env
+}
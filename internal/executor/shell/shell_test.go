@@ -0,0 +1,108 @@
+package shell
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/snake-runner/internal/executor"
+	"github.com/stretchr/testify/assert"
+)
+
+func runShell(
+	ctx context.Context,
+	cmd string,
+	env ...string,
+) (string, error) {
+	shell := NewShell()
+
+	container, err := shell.CreateContainer(
+		ctx,
+		executor.ContainerConfig{Name: "test"},
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	defer shell.DestroyContainer(context.Background(), container)
+
+	mutex := sync.Mutex{}
+	output := strings.Builder{}
+
+	err = shell.Exec(
+		ctx,
+		container,
+		executor.ExecConfig{
+			Cmd:          []string{"sh", "-c", cmd},
+			Env:          env,
+			AttachStdout: true,
+			AttachStderr: true,
+		},
+		func(text string) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			output.WriteString(text)
+		},
+	)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return output.String(), err
+}
+
+func TestExec(t *testing.T) {
+	test := assert.New(t)
+
+	os.Setenv(PrivateEnvPrefix+"TEST_TOKEN", "secret")
+	defer os.Unsetenv(PrivateEnvPrefix + "TEST_TOKEN")
+
+	output, err := runShell(
+		context.Background(),
+		`echo stdout; echo stderr >&2; echo "$FOO:$`+PrivateEnvPrefix+`TEST_TOKEN"`,
+		"FOO=bar",
+	)
+	test.NoError(err)
+	test.Equal("stdout\nstderr\nbar:\n", output)
+}
+
+func TestExecReturnsExitCode(t *testing.T) {
+	test := assert.New(t)
+
+	output, err := runShell(context.Background(), "echo failing; exit 3")
+	test.Equal("failing\n", output)
+	test.True(karma.Contains(err, executor.ErrNonZeroExitCode))
+	test.Contains(err.Error(), "exitcode: 3")
+}
+
+func TestExecIsCanceled(t *testing.T) {
+	test := assert.New(t)
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		time.Millisecond*100,
+	)
+	defer cancel()
+
+	started := time.Now()
+
+	_, err := runShell(ctx, "echo started; sleep 10; echo unreachable")
+	test.Equal(context.DeadlineExceeded, err)
+	test.True(time.Since(started) < time.Second*5)
+}
+
+func TestExecDoesNotWaitForBackgroundProcesses(t *testing.T) {
+	test := assert.New(t)
+
+	started := time.Now()
+
+	output, err := runShell(context.Background(), "sleep 10 & echo started")
+	test.NoError(err)
+	test.Equal("started\n", output)
+	test.True(time.Since(started) < time.Second*5)
+}
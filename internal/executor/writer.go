@@ -0,0 +1,18 @@
+package executor
+
+// OutputWriter passes everything written into it to the given consumer.
+type OutputWriter struct {
+	callback OutputConsumer
+}
+
+func NewOutputWriter(callback OutputConsumer) *OutputWriter {
+	return &OutputWriter{callback: callback}
+}
+
+func (writer *OutputWriter) Write(data []byte) (int, error) {
+	if writer.callback == nil {
+		return len(data), nil
+	}
+	writer.callback(string(data))
+	return len(data), nil
+}
@@ -2,20 +2,113 @@ package sidecar
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/docker/docker/api/types"
 	"github.com/reconquest/karma-go"
 	"github.com/reconquest/pkg/log"
-	"github.com/reconquest/snake-runner/internal/cloud"
+	"github.com/reconquest/snake-runner/internal/cache"
+	"github.com/reconquest/snake-runner/internal/config"
+	"github.com/reconquest/snake-runner/internal/executor"
 	"github.com/reconquest/snake-runner/internal/sshkey"
 )
 
 const (
 	SidecarImage = "reconquest/snake-runner-sidecar"
+
+	// CacheDir is a directory in the pipelines dir where caches of jobs are
+	// stored.
+	CacheDir = "cache"
+
+	// MirrorsDir is a directory in the pipelines dir where bare mirrors of
+	// repositories are stored.
+	MirrorsDir = "mirrors"
+
+	// MergeUserName and MergeUserEmail are used as an author of pull request
+	// merges created by runner.
+	MergeUserName  = "Snake Runner"
+	MergeUserEmail = "snake-runner@localhost"
 )
 
+// MirrorScript creates or updates a bare mirror of the repository, it's
+// executed as: sh -c script sh <mirror> <url>
+const MirrorScript = `
+set -e
+mirror="$1"
+url="$2"
+git init --quiet --bare "$mirror"
+git -C "$mirror" config remote.origin.url "$url"
+git -C "$mirror" config remote.origin.fetch '+refs/*:refs/*'
+git -C "$mirror" config remote.origin.mirror true
+git -C "$mirror" fetch --prune --quiet origin
+`
+
+// ArchiveScript archives files matching given patterns, the archive is
+// replaced atomically. It's executed as:
+// sh -c script sh <dir> <archive> <pattern>...
+const ArchiveScript = `
+set -e
+cd "$1"
+archive="$2"
+shift 2
+mkdir -p "$(dirname "$archive")"
+list="$(mktemp "$archive.list.XXXXXX")"
+for pattern do
+	found=
+	for path in $pattern; do
+		if [ -e "$path" ]; then
+			printf '%s\n' "$path" >> "$list"
+			found=1
+		fi
+	done
+	if [ -z "$found" ]; then
+		printf 'no files match path: %s\n' "$pattern"
+	fi
+done
+if [ -s "$list" ]; then
+	temp="$(mktemp "$archive.XXXXXX")"
+	tar -czf "$temp" -T "$list"
+	mv "$temp" "$archive"
+fi
+rm -f "$list"
+`
+
+// CopyScript copies the repository directory preserving permissions and
+// ownership. It's executed as: sh -c script sh <source> <target>
+const CopyScript = `
+set -e
+rm -rf "$2"
+mkdir -p "$(dirname "$2")"
+cp -a "$1" "$2"
+`
+
+// ExtractScript extracts given archives if they exist, modification time of
+// the archives is updated in order to track their usage. It's executed as:
+// sh -c script sh <dir> <archive>...
+const ExtractScript = `
+set -e
+dir="$1"
+shift
+for archive do
+	if [ -f "$archive" ]; then
+		touch "$archive"
+		tar -xzf "$archive" -C "$dir"
+	fi
+done
+`
+
+// ErrFileNotFound is a reason of errors returned by ReadFile when the file
+// doesn't exist at the given commit.
+var ErrFileNotFound = errors.New("file not found")
+
+// ErrMergeConflict is a reason of errors returned by Merge when the pull
+// request can't be merged into the target branch because of conflicts.
+var ErrMergeConflict = errors.New("pull request has merge conflicts")
+
 const SSHConfigWithoutVerification = `Host *
 	StrictHostKeyChecking no
 	UserKnownHostsFile /dev/null
@@ -23,17 +116,31 @@ const SSHConfigWithoutVerification = `Host *
 
 //go:generate gonstructor -type Sidecar -constructorTypes builder
 type Sidecar struct {
-	cloud           *cloud.Cloud
+	executor        executor.Executor
 	name            string
 	pipelinesDir    string
 	slug            string
-	commandConsumer cloud.CommandConsumer
-	outputConsumer  cloud.OutputConsumer
+	commandConsumer executor.CommandConsumer
+	outputConsumer  executor.OutputConsumer
 	sshKey          sshkey.Key
+	network         string
+
+	container    *executor.Container `gonstructor:"-"`
+	containerDir string              `gonstructor:"-"`
+	hostSubDir   string              `gonstructor:"-"`
+	hostDir      string              `gonstructor:"-"`
+	sshDir       string              `gonstructor:"-"`
+	cloneURL     string              `gonstructor:"-"`
+	mirrored     bool                `gonstructor:"-"`
+	cloned       bool                `gonstructor:"-"`
+
+	// dir is the repository directory inside the sidecar container, it
+	// differs from containerDir for forks since all forks are mounted to job
+	// containers at the same path
+	dir string `gonstructor:"-"`
 
-	container    *cloud.Container `gonstructor:"-"`
-	containerDir string           `gonstructor:"-"`
-	hostSubDir   string           `gonstructor:"-"`
+	// parent is the sidecar which owns the container if this one is a fork
+	parent *Sidecar `gonstructor:"-"`
 }
 
 func (sidecar *Sidecar) GetPipelineVolumes() []string {
@@ -44,39 +151,54 @@ func (sidecar *Sidecar) GetContainerDir() string {
 	return sidecar.containerDir
 }
 
-func (sidecar *Sidecar) GetContainer() *cloud.Container {
+func (sidecar *Sidecar) GetContainer() *executor.Container {
 	return sidecar.container
 }
 
 func (sidecar *Sidecar) create(ctx context.Context) error {
-	img, err := sidecar.cloud.GetImageWithTag(ctx, SidecarImage)
+	_, err := sidecar.executor.EnsureImage(
+		ctx,
+		SidecarImage,
+		executor.PullPolicyIfNotPresent,
+		nil,
+		sidecar.outputConsumer,
+	)
 	if err != nil {
-		return err
-	}
-
-	if img == nil {
-		err := sidecar.cloud.PullImage(ctx, SidecarImage, sidecar.outputConsumer)
-		if err != nil {
-			return karma.Format(
-				err,
-				"unable to pull sidecar image: %s", SidecarImage,
-			)
-		}
+		return karma.Format(
+			err,
+			"unable to pull sidecar image: %s", SidecarImage,
+		)
 	}
 
 	sidecar.hostSubDir = filepath.Join(sidecar.pipelinesDir, sidecar.name)
-	sidecar.containerDir = filepath.Join("/pipelines/", sidecar.slug)
 
-	volumes := []string{
-		sidecar.hostSubDir + ":" + sidecar.containerDir + ":rw",
-		sidecar.pipelinesDir + ":/host:rw",
+	var volumes []string
+	if sidecar.executor.Type() == executor.TypeShell {
+		// there is no container at all, everything happens right in the
+		// pipelines dir and the ssh key should not touch ~/.ssh of the user
+		sidecar.containerDir = sidecar.hostSubDir
+		sidecar.hostDir = sidecar.pipelinesDir
+		sidecar.sshDir = sidecar.hostSubDir + ".ssh"
+	} else {
+		sidecar.containerDir = filepath.Join("/pipelines/", sidecar.slug)
+		sidecar.hostDir = "/host"
+
+		volumes = []string{
+			sidecar.hostSubDir + ":" + sidecar.containerDir + ":rw",
+			sidecar.pipelinesDir + ":" + sidecar.hostDir + ":rw",
+		}
 	}
 
-	sidecar.container, err = sidecar.cloud.CreateContainer(
+	sidecar.dir = sidecar.containerDir
+
+	sidecar.container, err = sidecar.executor.CreateContainer(
 		ctx,
-		SidecarImage,
-		"snake-runner-sidecar-"+sidecar.name,
-		volumes,
+		executor.ContainerConfig{
+			Image:          SidecarImage,
+			Name:           "snake-runner-sidecar-" + sidecar.name,
+			Volumes:        volumes,
+			DefaultNetwork: sidecar.network,
+		},
 	)
 	if err != nil {
 		return karma.Format(
@@ -88,7 +210,9 @@ func (sidecar *Sidecar) create(ctx context.Context) error {
 	return nil
 }
 
-func (sidecar *Sidecar) Serve(ctx context.Context, cloneURL string, commitish string) error {
+// Serve creates the sidecar container and updates the mirror of the
+// repository, the repository itself is cloned by Checkout.
+func (sidecar *Sidecar) Serve(ctx context.Context, cloneURL string) error {
 	err := sidecar.create(ctx)
 	if err != nil {
 		return err
@@ -98,20 +222,21 @@ func (sidecar *Sidecar) Serve(ctx context.Context, cloneURL string, commitish st
 		"__SNAKE_PRIVATE_KEY=" + string(sidecar.sshKey.Private),
 		"__SNAKE_PUBLIC_KEY=" + string(sidecar.sshKey.Public),
 		"__SNAKE_SSH_CONFIG=" + SSHConfigWithoutVerification,
+		"__SNAKE_SSH_DIR=" + sidecar.sshDir,
 	}
 
 	basic := []string{
-		`mkdir ~/.ssh`,
-		`cat > ~/.ssh/id_rsa <<< "$__SNAKE_PRIVATE_KEY"`,
-		`cat > ~/.ssh/id_rsa.pub <<< "$__SNAKE_PUBLIC_KEY"`,
-		`cat > ~/.ssh/config <<< "$__SNAKE_SSH_CONFIG"`,
-		`chmod 0600 ~/.ssh/id_rsa ~/.ssh/id_rsa.pub`,
-		`git config --global advice.detachedHead false`,
+		`umask 077`,
+		`dir="${__SNAKE_SSH_DIR:-$HOME/.ssh}"`,
+		`mkdir -p "$dir"`,
+		`printf '%s\n' "$__SNAKE_PRIVATE_KEY" > "$dir/id_rsa"`,
+		`printf '%s\n' "$__SNAKE_PUBLIC_KEY" > "$dir/id_rsa.pub"`,
+		`printf '%s\n' "$__SNAKE_SSH_CONFIG" > "$dir/config"`,
 	}
 
-	cmd := []string{"bash", "-c", strings.Join(basic, " && ")}
+	cmd := []string{"sh", "-c", strings.Join(basic, " && ")}
 
-	err = sidecar.cloud.Exec(ctx, sidecar.container, types.ExecConfig{
+	err = sidecar.executor.Exec(ctx, sidecar.container, executor.ExecConfig{
 		Cmd:          cmd,
 		Env:          env,
 		AttachStdout: true,
@@ -124,30 +249,856 @@ func (sidecar *Sidecar) Serve(ctx context.Context, cloneURL string, commitish st
 		)
 	}
 
+	sidecar.cloneURL = cloneURL
+
+	err = sidecar.updateMirror(ctx)
+	if err != nil {
+		log.Errorf(err, "unable to update mirror of %s", sidecar.slug)
+
+		sidecar.outputConsumer(
+			"\n:: Unable to update repository mirror, cloning without it\n",
+		)
+	} else {
+		sidecar.mirrored = true
+	}
+
+	return nil
+}
+
+// Fork returns a sidecar which works with a separate copy of the repository
+// directory in the same container, so jobs running at the same time don't
+// overwrite files of each other. The copy is created by Copy and removed by
+// Destroy of the fork, forks of a fork are forks of its parent. The name
+// must be unique within the pipeline.
+func (sidecar *Sidecar) Fork(name string) *Sidecar {
+	parent := sidecar
+	if sidecar.parent != nil {
+		parent = sidecar.parent
+	}
+
+	fork := *parent
+	fork.parent = parent
+	fork.hostSubDir = filepath.Join(parent.getForksDir(parent.pipelinesDir), name)
+	fork.dir = filepath.Join(parent.getForksDir(parent.hostDir), name)
+
+	if parent.executor.Type() == executor.TypeShell {
+		fork.containerDir = fork.dir
+	}
+
+	return &fork
+}
+
+// Copy copies the repository directory of the parent into the directory of
+// the fork, leftovers of a previous copy are removed.
+func (sidecar *Sidecar) Copy(
+	ctx context.Context,
+	callback executor.OutputConsumer,
+) error {
+	if sidecar.parent == nil {
+		return errors.New("only fork of sidecar can be copied")
+	}
+
+	cmd := []string{
+		"sh", "-c", CopyScript, "sh",
+		sidecar.parent.dir,
+		sidecar.dir,
+	}
+
+	err := sidecar.executor.Exec(ctx, sidecar.container, executor.ExecConfig{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	}, callback)
+	if err != nil {
+		return karma.Describe("cmd", cmd).Format(
+			err,
+			"unable to copy repository directory",
+		)
+	}
+
+	return nil
+}
+
+// ReadFile returns contents of the file at given commit without checking out
+// the repository, so the pipeline config can be read before checkout.
+// ErrFileNotFound is a reason of the error if the commit has no such file.
+func (sidecar *Sidecar) ReadFile(
+	ctx context.Context,
+	commitish string,
+	path string,
+) (string, error) {
+	git := []string{`git`, `-C`, sidecar.dir}
+	if sidecar.mirrored {
+		git = []string{
+			`flock`, `-s`, sidecar.getMirrorDir() + ".lock",
+			`git`, `-C`, sidecar.getMirrorDir(),
+		}
+	} else {
+		// the file can't be read without the repository, so it's cloned
+		// without any options
+		err := sidecar.clone(ctx, config.Git{})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// the commit can be missing because of a race with a push, it's worth
+	// to try again, but a missing file is missing for good
+	err := sidecar.execQuiet(
+		ctx,
+		append(git, `cat-file`, `-e`, commitish+"^{commit}"),
+	)
+	if err != nil {
+		return "", karma.Format(err, "unable to find commit %s", commitish)
+	}
+
+	err = sidecar.execQuiet(
+		ctx,
+		append(git, `cat-file`, `-e`, commitish+":"+path),
+	)
+	if err != nil {
+		if karma.Contains(err, executor.ErrNonZeroExitCode) {
+			return "", karma.Describe("path", path).
+				Describe("commit", commitish).
+				Reason(ErrFileNotFound)
+		}
+
+		return "", err
+	}
+
+	cmd := append(git, `show`, commitish+":"+path)
+
+	output := ""
+	err = sidecar.executor.Exec(ctx, sidecar.container, executor.ExecConfig{
+		Cmd:          cmd,
+		AttachStdout: true,
+	}, func(text string) {
+		output += text
+	})
+	if err != nil {
+		return "", karma.Describe("cmd", cmd).Format(
+			err,
+			"unable to read file %q at %s",
+			path, commitish,
+		)
+	}
+
+	return output, nil
+}
+
+// Checkout clones the repository and checks out given commit honoring git
+// options of the pipeline.
+func (sidecar *Sidecar) Checkout(
+	ctx context.Context,
+	commitish string,
+	options config.Git,
+) error {
+	if sidecar.cloned && options.Depth > 0 {
+		sidecar.outputConsumer(
+			"\n:: Repository is already cloned, git depth is ignored\n",
+		)
+	}
+
+	err := sidecar.clone(ctx, options)
+	if err != nil {
+		return err
+	}
+
+	dir := sidecar.dir
+
+	if options.Depth > 0 {
+		// the commit can be unreachable from the branch tips within the
+		// given depth
+		err := sidecar.execQuiet(
+			ctx,
+			[]string{`git`, `-C`, dir, `cat-file`, `-e`, commitish + "^{commit}"},
+		)
+		if err != nil {
+			err = sidecar.exec(
+				ctx,
+				[]string{`git`, `-C`, dir, `fetch`, `--unshallow`, `origin`},
+				nil,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(options.Sparse) > 0 {
+		err := sidecar.exec(
+			ctx,
+			[]string{`git`, `-C`, dir, `config`, `core.sparseCheckout`, `true`},
+			nil,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = sidecar.execQuiet(
+			ctx,
+			append(
+				[]string{
+					`sh`, `-c`, `file="$1"; shift; printf '%s\n' "$@" > "$file"`,
+					`sh`, filepath.Join(dir, ".git", "info", "sparse-checkout"),
+				},
+				options.Sparse...,
+			),
+		)
+		if err != nil {
+			return karma.Format(err, "unable to write sparse-checkout patterns")
+		}
+	}
+
+	var env []string
+	if !options.LFS {
+		env = []string{"GIT_LFS_SKIP_SMUDGE=1"}
+	}
+
+	err = sidecar.exec(
+		ctx,
+		[]string{
+			`git`, `-C`, dir,
+			`-c`, `advice.detachedHead=false`,
+			`checkout`, commitish,
+		},
+		env,
+	)
+	if err != nil {
+		return err
+	}
+
+	switch options.Submodules {
+	case config.SubmodulesNormal:
+		err = sidecar.exec(
+			ctx,
+			[]string{`git`, `-C`, dir, `submodule`, `update`, `--init`},
+			env,
+		)
+	case config.SubmodulesRecursive:
+		err = sidecar.exec(
+			ctx,
+			[]string{
+				`git`, `-C`, dir,
+				`submodule`, `update`, `--init`, `--recursive`,
+			},
+			env,
+		)
+	}
+	if err != nil {
+		return err
+	}
+
+	if options.LFS {
+		err = sidecar.exec(ctx, []string{`git`, `-C`, dir, `lfs`, `pull`}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Merge creates the merge result of the pull request and returns its hash.
+// The merge ref of the pull request is used if it's up to date with the given
+// commit, otherwise the commit is merged into the target branch locally.
+func (sidecar *Sidecar) Merge(
+	ctx context.Context,
+	pullRequestID int,
+	commit string,
+	targetBranch string,
+	options config.Git,
+) (string, error) {
+	err := sidecar.clone(ctx, options)
+	if err != nil {
+		return "", err
+	}
+
+	dir := sidecar.dir
+
+	err = sidecar.exec(
+		ctx,
+		[]string{
+			`git`, `-C`, dir, `fetch`, `origin`,
+			fmt.Sprintf(
+				"+refs/pull-requests/%d/merge:refs/snake/merge",
+				pullRequestID,
+			),
+		},
+		nil,
+	)
+	if err == nil {
+		parent, err := sidecar.Resolve(ctx, "refs/snake/merge^2")
+		if err == nil && commit != "" && strings.HasPrefix(parent, commit) {
+			return sidecar.Resolve(ctx, "refs/snake/merge")
+		}
+	}
+
+	sidecar.outputConsumer(
+		"\n:: Merge ref of the pull request is unavailable or outdated, " +
+			"merging locally\n",
+	)
+
+	if targetBranch == "" {
+		return "", errors.New("target branch of the pull request is unknown")
+	}
+
+	fetch := []string{`git`, `-C`, dir, `fetch`}
+
+	// merge base can't be found in a shallow repository
+	err = sidecar.execQuiet(
+		ctx,
+		[]string{`test`, `-f`, filepath.Join(dir, ".git", "shallow")},
+	)
+	if err == nil {
+		fetch = append(fetch, `--unshallow`)
+	}
+
+	fetch = append(
+		fetch,
+		`origin`, "+refs/heads/"+targetBranch+":refs/snake/target",
+	)
+
+	err = sidecar.exec(ctx, fetch, nil)
+	if err != nil {
+		return "", karma.Format(
+			err,
+			"unable to fetch target branch %s",
+			targetBranch,
+		)
+	}
+
+	// merging a commit which is in the target branch already creates no merge
+	// commit, so the commit itself is tested
+	err = sidecar.execQuiet(
+		ctx,
+		[]string{
+			`git`, `-C`, dir,
+			`merge-base`, `--is-ancestor`, commit, `refs/snake/target`,
+		},
+	)
+	if err == nil {
+		sidecar.outputConsumer(
+			fmt.Sprintf(
+				"\n:: Pull request is merged into %s already, "+
+					"using its commit as is\n",
+				targetBranch,
+			),
+		)
+
+		return sidecar.Resolve(ctx, commit)
+	}
+
 	commands := [][]string{
-		{`git`, `clone`, cloneURL, sidecar.containerDir},
-		{`git`, `-C`, sidecar.containerDir, `checkout`, commitish},
+		{
+			`git`, `-C`, dir,
+			`-c`, `advice.detachedHead=false`,
+			`checkout`, `--detach`, `refs/snake/target`,
+		},
+		{
+			`git`, `-C`, dir,
+			`-c`, `user.name=` + MergeUserName,
+			`-c`, `user.email=` + MergeUserEmail,
+			`merge`, `--no-ff`, `--no-edit`, commit,
+		},
 	}
 
 	for _, cmd := range commands {
-		sidecar.commandConsumer(cmd)
+		err := sidecar.exec(ctx, cmd, []string{"GIT_LFS_SKIP_SMUDGE=1"})
+		if err != nil {
+			conflicts, _ := sidecar.output(ctx, []string{`git`, `ls-files`, `-u`})
+			if conflicts != "" {
+				err = karma.Describe("branch", targetBranch).
+					Reason(ErrMergeConflict)
+			}
+
+			return "", karma.Format(
+				err,
+				"unable to merge pull request into %s",
+				targetBranch,
+			)
+		}
+	}
+
+	return sidecar.Resolve(ctx, "HEAD")
+}
+
+// Resolve returns hash of the given revision in the cloned repository.
+func (sidecar *Sidecar) Resolve(ctx context.Context, rev string) (string, error) {
+	return sidecar.output(ctx, []string{`git`, `rev-parse`, `--verify`, rev})
+}
+
+// GetMergeBase returns the best common ancestor of given revisions.
+func (sidecar *Sidecar) GetMergeBase(
+	ctx context.Context,
+	a string,
+	b string,
+) (string, error) {
+	return sidecar.output(ctx, []string{`git`, `merge-base`, a, b})
+}
+
+// Commit is metadata of a commit in the cloned repository.
+type Commit struct {
+	Hash        string
+	AuthorName  string
+	AuthorEmail string
+	Timestamp   time.Time
+	Title       string
+	Message     string
+	Parents     []string
+}
+
+// commitFormat is a format of git show, fields are separated by NUL since
+// the message can contain anything else.
+const commitFormat = `%H%x00%an%x00%ae%x00%cI%x00%P%x00%s%x00%B`
+
+// GetCommit returns metadata of the given revision.
+func (sidecar *Sidecar) GetCommit(
+	ctx context.Context,
+	rev string,
+) (Commit, error) {
+	output, err := sidecar.output(
+		ctx,
+		[]string{`git`, `show`, `--no-patch`, `--format=` + commitFormat, rev},
+	)
+	if err != nil {
+		return Commit{}, err
+	}
+
+	fields := strings.SplitN(output, "\x00", 7)
+	if len(fields) != 7 {
+		return Commit{}, fmt.Errorf("unexpected output of git show: %q", output)
+	}
 
-		err = sidecar.cloud.Exec(ctx, sidecar.container, types.ExecConfig{
-			// NO ENV!
+	timestamp, err := time.Parse(time.RFC3339, fields[3])
+	if err != nil {
+		return Commit{}, karma.Format(err, "unable to parse commit timestamp")
+	}
+
+	return Commit{
+		Hash:        fields[0],
+		AuthorName:  fields[1],
+		AuthorEmail: fields[2],
+		Timestamp:   timestamp,
+		Parents:     strings.Fields(fields[4]),
+		Title:       fields[5],
+		Message:     strings.TrimSpace(fields[6]),
+	}, nil
+}
+
+// GetChangedFiles returns paths of files changed between given revisions, if
+// from is empty then files of the commit itself are returned. The result is
+// never nil if there is no error.
+func (sidecar *Sidecar) GetChangedFiles(
+	ctx context.Context,
+	from string,
+	to string,
+) ([]string, error) {
+	cmd := []string{`git`, `diff`, `--name-only`, `-z`, from, to}
+	if from == "" {
+		cmd = []string{
+			`git`, `diff-tree`, `--root`, `-r`, `--no-commit-id`,
+			`--name-only`, `-z`, to,
+		}
+	}
+
+	output, err := sidecar.output(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, path := range strings.Split(output, "\x00") {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+
+	return files, nil
+}
+
+// output runs a git command in the cloned repository and returns its
+// stdout.
+func (sidecar *Sidecar) output(ctx context.Context, cmd []string) (string, error) {
+	cmd = append([]string{cmd[0], `-C`, sidecar.dir}, cmd[1:]...)
+
+	output := ""
+	err := sidecar.executor.Exec(ctx, sidecar.container, executor.ExecConfig{
+		Cmd:          cmd,
+		AttachStdout: true,
+	}, func(text string) {
+		output += text
+	})
+	if err != nil {
+		return "", karma.Describe("cmd", cmd).Reason(err)
+	}
+
+	return strings.TrimSpace(output), nil
+}
+
+// clone clones the repository without checking out files, objects are taken
+// from the mirror if it's available.
+func (sidecar *Sidecar) clone(ctx context.Context, options config.Git) error {
+	if sidecar.cloned {
+		return nil
+	}
+
+	cmd := []string{`git`, `clone`, `--no-checkout`}
+	if options.Depth > 0 {
+		cmd = append(
+			cmd,
+			`--depth`, strconv.Itoa(options.Depth),
+			`--no-single-branch`,
+		)
+	}
+
+	if sidecar.mirrored {
+		cmd = append(cmd, `--reference`, sidecar.getMirrorDir(), `--dissociate`)
+	}
+
+	cmd = append(cmd, sidecar.cloneURL, sidecar.dir)
+
+	sidecar.commandConsumer(cmd)
+
+	if sidecar.mirrored {
+		// the mirror must not be updated while objects are copied from it
+		cmd = append(
+			[]string{`flock`, `-s`, sidecar.getMirrorDir() + ".lock"},
+			cmd...,
+		)
+	}
+
+	err := sidecar.executor.Exec(ctx, sidecar.container, executor.ExecConfig{
+		// NO PRIVATE KEY IN ENV!
+		Cmd:          cmd,
+		Env:          sidecar.getGitEnv(),
+		AttachStdout: true,
+		AttachStderr: true,
+	}, sidecar.outputConsumer)
+	if err != nil {
+		return karma.
+			Describe("cmd", cmd).
+			Format(err, "unable to clone repository")
+	}
+
+	sidecar.cloned = true
+
+	return nil
+}
+
+// exec runs a git command showing it to the user.
+func (sidecar *Sidecar) exec(ctx context.Context, cmd []string, env []string) error {
+	sidecar.commandConsumer(cmd)
+
+	err := sidecar.executor.Exec(ctx, sidecar.container, executor.ExecConfig{
+		Cmd:          cmd,
+		Env:          append(sidecar.getGitEnv(), env...),
+		AttachStdout: true,
+		AttachStderr: true,
+	}, sidecar.outputConsumer)
+	if err != nil {
+		return karma.
+			Describe("cmd", cmd).
+			Format(err, "unable to setup repository")
+	}
+
+	return nil
+}
+
+// execQuiet runs a helper command, its output is written only to the
+// runner log.
+func (sidecar *Sidecar) execQuiet(ctx context.Context, cmd []string) error {
+	err := sidecar.executor.Exec(ctx, sidecar.container, executor.ExecConfig{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	}, sidecar.onlyLog)
+	if err != nil {
+		return karma.Describe("cmd", cmd).Reason(err)
+	}
+
+	return nil
+}
+
+// updateMirror fetches the repository into the bare mirror on the host,
+// the mirror is shared between pipelines of the same repository and is
+// locked exclusively while it's updated.
+func (sidecar *Sidecar) updateMirror(ctx context.Context) error {
+	mirror := sidecar.getMirrorDir()
+
+	sidecar.outputConsumer(
+		fmt.Sprintf("\n:: Updating repository mirror: %s\n", sidecar.slug),
+	)
+
+	commands := [][]string{
+		{`mkdir`, `-p`, filepath.Dir(mirror)},
+		{
+			`flock`, mirror + ".lock",
+			`sh`, `-c`, MirrorScript, `sh`, mirror, sidecar.cloneURL,
+		},
+	}
+
+	for _, cmd := range commands {
+		err := sidecar.executor.Exec(ctx, sidecar.container, executor.ExecConfig{
 			Cmd:          cmd,
+			Env:          sidecar.getGitEnv(),
 			AttachStdout: true,
 			AttachStderr: true,
 		}, sidecar.outputConsumer)
 		if err != nil {
-			return karma.
-				Describe("cmd", cmd).
-				Format(err, "unable to setup repository")
+			return karma.Describe("cmd", cmd).Reason(err)
 		}
 	}
 
 	return nil
 }
 
+func (sidecar *Sidecar) getMirrorDir() string {
+	return filepath.Join(sidecar.hostDir, MirrorsDir, sidecar.slug+".git")
+}
+
+// SaveArtifacts archives files matching given patterns in the repository
+// directory and puts the archive to the artifacts store of the pipeline under
+// given key.
+func (sidecar *Sidecar) SaveArtifacts(
+	ctx context.Context,
+	key string,
+	patterns []string,
+	callback executor.OutputConsumer,
+) error {
+	cmd := append(
+		[]string{
+			"sh", "-c", ArchiveScript, "sh",
+			sidecar.dir,
+			sidecar.getArtifactsPath(key),
+		},
+		patterns...,
+	)
+
+	err := sidecar.executor.Exec(ctx, sidecar.container, executor.ExecConfig{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	}, callback)
+	if err != nil {
+		return karma.Describe("patterns", patterns).Format(
+			err,
+			"unable to archive artifacts",
+		)
+	}
+
+	return nil
+}
+
+// RestoreArtifacts extracts artifacts saved under given keys into the
+// repository directory, missing artifacts are ignored.
+func (sidecar *Sidecar) RestoreArtifacts(
+	ctx context.Context,
+	keys []string,
+	callback executor.OutputConsumer,
+) error {
+	cmd := []string{
+		"sh", "-c", ExtractScript, "sh",
+		sidecar.dir,
+	}
+
+	for _, key := range keys {
+		cmd = append(cmd, sidecar.getArtifactsPath(key))
+	}
+
+	err := sidecar.executor.Exec(ctx, sidecar.container, executor.ExecConfig{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	}, callback)
+	if err != nil {
+		return karma.Describe("keys", keys).Format(
+			err,
+			"unable to extract artifacts",
+		)
+	}
+
+	return nil
+}
+
+// Checksum returns sha256 checksum of given files in the repository
+// directory.
+func (sidecar *Sidecar) Checksum(
+	ctx context.Context,
+	files []string,
+) (string, error) {
+	output := ""
+	cmd := append([]string{"sha256sum", "--"}, files...)
+
+	err := sidecar.executor.Exec(ctx, sidecar.container, executor.ExecConfig{
+		Cmd:          cmd,
+		WorkingDir:   sidecar.dir,
+		AttachStdout: true,
+		AttachStderr: true,
+	}, func(text string) {
+		output += text
+	})
+	if err != nil {
+		return "", karma.Describe("cmd", cmd).Describe("output", output).Format(
+			err,
+			"unable to calculate checksum of files",
+		)
+	}
+
+	return output, nil
+}
+
+// SaveCache archives files matching given patterns in the repository
+// directory and puts the archive to the cache of the repository. The cache
+// is shared between pipelines.
+func (sidecar *Sidecar) SaveCache(
+	ctx context.Context,
+	key string,
+	patterns []string,
+	callback executor.OutputConsumer,
+) error {
+	cmd := append(
+		[]string{
+			"sh", "-c", ArchiveScript, "sh",
+			sidecar.dir,
+			sidecar.getCachePath(key),
+		},
+		patterns...,
+	)
+
+	err := sidecar.executor.Exec(ctx, sidecar.container, executor.ExecConfig{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	}, callback)
+	if err != nil {
+		return karma.Describe("patterns", patterns).Format(
+			err,
+			"unable to archive cache",
+		)
+	}
+
+	return nil
+}
+
+// RestoreCache extracts the cache saved under given key into the repository
+// directory, false is returned if there is no such cache.
+func (sidecar *Sidecar) RestoreCache(
+	ctx context.Context,
+	key string,
+	callback executor.OutputConsumer,
+) (bool, error) {
+	path := sidecar.getCachePath(key)
+
+	err := sidecar.executor.Exec(ctx, sidecar.container, executor.ExecConfig{
+		Cmd:          []string{"test", "-f", path},
+		AttachStdout: true,
+		AttachStderr: true,
+	}, callback)
+	if err != nil {
+		if karma.Contains(err, executor.ErrNonZeroExitCode) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	cmd := []string{
+		"sh", "-c", ExtractScript, "sh",
+		sidecar.dir,
+		path,
+	}
+
+	err = sidecar.executor.Exec(ctx, sidecar.container, executor.ExecConfig{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	}, callback)
+	if err != nil {
+		return false, karma.Format(err, "unable to extract cache")
+	}
+
+	return true, nil
+}
+
+// PruneCache removes least recently used caches of all repositories until
+// their total size fits the limit, the cache dir is accessible only through
+// the sidecar container. Paths of removed caches are returned.
+func (sidecar *Sidecar) PruneCache(
+	ctx context.Context,
+	limit int64,
+) ([]string, error) {
+	dir := filepath.Join(sidecar.hostDir, CacheDir)
+
+	output := ""
+	cmd := []string{"sh", "-c", cache.ListScript, "sh", dir}
+
+	err := sidecar.executor.Exec(ctx, sidecar.container, executor.ExecConfig{
+		Cmd:          cmd,
+		AttachStdout: true,
+	}, func(text string) {
+		output += text
+	})
+	if err != nil {
+		return nil, karma.Describe("cmd", cmd).Format(
+			err,
+			"unable to list caches: %s", dir,
+		)
+	}
+
+	entries, err := cache.ParseList(output)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := cache.Evict(entries, limit)
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	err = sidecar.execQuiet(ctx, append([]string{"rm", "-f", "--"}, removed...))
+	if err != nil {
+		return nil, karma.Format(err, "unable to remove caches")
+	}
+
+	return removed, nil
+}
+
+func (sidecar *Sidecar) getCachePath(key string) string {
+	return filepath.Join(sidecar.hostDir, CacheDir, sidecar.slug, key+".tar.gz")
+}
+
+// getArtifactsDir returns the artifacts store of the pipeline, it's shared
+// by all forks.
+func (sidecar *Sidecar) getArtifactsDir() string {
+	if sidecar.parent != nil {
+		return sidecar.parent.getArtifactsDir()
+	}
+
+	return filepath.Join(sidecar.hostDir, sidecar.name+".artifacts")
+}
+
+func (sidecar *Sidecar) getForksDir(root string) string {
+	return filepath.Join(root, sidecar.name+".forks")
+}
+
+func (sidecar *Sidecar) getArtifactsPath(key string) string {
+	return filepath.Join(sidecar.getArtifactsDir(), key+".tar.gz")
+}
+
+func (sidecar *Sidecar) getGitEnv() []string {
+	if sidecar.sshDir == "" {
+		return nil
+	}
+
+	return []string{
+		"GIT_SSH_COMMAND=ssh" +
+			" -F " + filepath.Join(sidecar.sshDir, "config") +
+			" -i " + filepath.Join(sidecar.sshDir, "id_rsa") +
+			" -o IdentitiesOnly=yes",
+	}
+}
+
 func (sidecar *Sidecar) onlyLog(text string) {
 	log.Debugf(
 		nil,
@@ -163,8 +1114,35 @@ func (sidecar *Sidecar) Destroy() {
 	// we use Background context here because local ctx can be destroyed
 	// already
 
+	if sidecar.parent != nil {
+		// the container belongs to the parent, only the copy is removed
+		err := sidecar.executor.Exec(
+			context.Background(),
+			sidecar.container,
+			executor.ExecConfig{
+				Cmd:          []string{"rm", "-rf", sidecar.dir},
+				AttachStderr: true,
+				AttachStdout: true,
+			},
+			sidecar.onlyLog,
+		)
+		if err != nil {
+			log.Errorf(err, "unable to cleanup fork directory: %s", sidecar.dir)
+		}
+
+		return
+	}
+
 	if sidecar.name != "" {
-		cmd := []string{"rm", "-rf", filepath.Join("/host", sidecar.name)}
+		cmd := []string{
+			"rm", "-rf",
+			filepath.Join(sidecar.hostDir, sidecar.name),
+			sidecar.getArtifactsDir(),
+			sidecar.getForksDir(sidecar.hostDir),
+		}
+		if sidecar.sshDir != "" {
+			cmd = append(cmd, sidecar.sshDir)
+		}
 
 		log.Debugf(
 			nil,
@@ -172,10 +1150,10 @@ func (sidecar *Sidecar) Destroy() {
 			sidecar.container.Name, cmd,
 		)
 
-		err := sidecar.cloud.Exec(
+		err := sidecar.executor.Exec(
 			context.Background(),
 			sidecar.container,
-			types.ExecConfig{Cmd: cmd, AttachStderr: true, AttachStdout: true},
+			executor.ExecConfig{Cmd: cmd, AttachStderr: true, AttachStdout: true},
 			sidecar.onlyLog,
 		)
 		if err != nil {
@@ -194,7 +1172,7 @@ func (sidecar *Sidecar) Destroy() {
 		sidecar.container.Name,
 	)
 
-	err := sidecar.cloud.DestroyContainer(context.Background(), sidecar.container)
+	err := sidecar.executor.DestroyContainer(context.Background(), sidecar.container)
 	if err != nil {
 		log.Errorf(
 			err,
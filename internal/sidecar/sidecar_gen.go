@@ -3,25 +3,26 @@
 package sidecar
 
 import (
-	"github.com/reconquest/snake-runner/internal/cloud"
+	"github.com/reconquest/snake-runner/internal/executor"
 	"github.com/reconquest/snake-runner/internal/sshkey"
 )
 
 type SidecarBuilder struct {
-	cloud           *cloud.Cloud
+	executor        executor.Executor
 	name            string
 	pipelinesDir    string
 	slug            string
-	commandConsumer cloud.CommandConsumer
-	outputConsumer  cloud.OutputConsumer
+	commandConsumer executor.CommandConsumer
+	outputConsumer  executor.OutputConsumer
 	sshKey          sshkey.Key
+	network         string
 }
 
 func NewSidecarBuilder() *SidecarBuilder {
 	return &SidecarBuilder{}
 }
-func (b *SidecarBuilder) Cloud(cloud *cloud.Cloud) *SidecarBuilder {
-	b.cloud = cloud
+func (b *SidecarBuilder) Executor(executor executor.Executor) *SidecarBuilder {
+	b.executor = executor
 	return b
 }
 func (b *SidecarBuilder) Name(name string) *SidecarBuilder {
@@ -36,11 +37,11 @@ func (b *SidecarBuilder) Slug(slug string) *SidecarBuilder {
 	b.slug = slug
 	return b
 }
-func (b *SidecarBuilder) CommandConsumer(commandConsumer cloud.CommandConsumer) *SidecarBuilder {
+func (b *SidecarBuilder) CommandConsumer(commandConsumer executor.CommandConsumer) *SidecarBuilder {
 	b.commandConsumer = commandConsumer
 	return b
 }
-func (b *SidecarBuilder) OutputConsumer(outputConsumer cloud.OutputConsumer) *SidecarBuilder {
+func (b *SidecarBuilder) OutputConsumer(outputConsumer executor.OutputConsumer) *SidecarBuilder {
 	b.outputConsumer = outputConsumer
 	return b
 }
@@ -48,6 +49,10 @@ func (b *SidecarBuilder) SshKey(sshKey sshkey.Key) *SidecarBuilder {
 	b.sshKey = sshKey
 	return b
 }
+func (b *SidecarBuilder) Network(network string) *SidecarBuilder {
+	b.network = network
+	return b
+}
 func (b *SidecarBuilder) Build() *Sidecar {
-	return &Sidecar{cloud: b.cloud, name: b.name, pipelinesDir: b.pipelinesDir, slug: b.slug, commandConsumer: b.commandConsumer, outputConsumer: b.outputConsumer, sshKey: b.sshKey}
+	return &Sidecar{executor: b.executor, name: b.name, pipelinesDir: b.pipelinesDir, slug: b.slug, commandConsumer: b.commandConsumer, outputConsumer: b.outputConsumer, sshKey: b.sshKey, network: b.network}
 }
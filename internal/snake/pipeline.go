@@ -16,4 +16,10 @@ type Pipeline struct {
 	RefType       string `json:"ref_type"`
 	RefDisplayId  string `json:"ref_display_id"`
 	PullRequestID int    `json:"pull_request_id"`
+
+	PullRequestTargetBranch string `json:"pull_request_target_branch"`
+
+	// PreviousSuccessfulCommit is a commit of the last successful pipeline
+	// of the same ref, it's empty if the server doesn't know it.
+	PreviousSuccessfulCommit string `json:"previous_successful_commit"`
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/reconquest/pkg/log"
+	"github.com/reconquest/snake-runner/internal/executor"
 	"github.com/reconquest/snake-runner/internal/responses"
 	"github.com/reconquest/snake-runner/internal/snake"
 )
@@ -58,6 +59,29 @@ type PipelineRun struct {
 	Env        map[string]string    `json:"env"`
 	Repository responses.Repository `json:"repository"`
 	Project    responses.Project    `json:"project"`
+
+	// Registries are credentials of private registries used by the
+	// pipeline, keyed by registry host.
+	Registries map[string]executor.RegistryCredentials `json:"registries"`
+
+	// Secrets are names of variables in Env which values are masked in logs.
+	Secrets []string `json:"secrets"`
+
+	// Files are names of variables in Env which values are written to files,
+	// the variables contain paths of the files.
+	Files []string `json:"files"`
+}
+
+// GetSecrets returns values of secret variables.
+func (task PipelineRun) GetSecrets() []string {
+	values := []string{}
+	for _, name := range task.Secrets {
+		if value, ok := task.Env[name]; ok {
+			values = append(values, value)
+		}
+	}
+
+	return values
 }
 
 type PipelineCancel struct {